@@ -2,20 +2,29 @@ package agileapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/user"
 	"strings"
+	"time"
 
 	"github.com/gorilla/rpc/v2/json2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AgileApi struct {
+	// Token is the token to start with.  Logging in again doesn't change
+	// it.
+	//
+	// Deprecated: use SessionToken, which has the token in use.
 	Token      string
 	Url        string
 	Username   string
@@ -23,6 +32,58 @@ type AgileApi struct {
 	Debug      bool
 	Secure     bool
 	TokenCache string
+	HTTPClient *http.Client
+	// Logger receives all diagnostics.  See Config.Logger.
+	Logger *slog.Logger
+	// Metrics, when set, observes every call.  See Config.Metrics.
+	Metrics Metrics
+	// TracerProvider, when set, is used instead of the global one.
+	TracerProvider trace.TracerProvider
+	// Limits, when set, throttles every request.  See Config.Limits.
+	Limits *Limits
+	// Cache, when set, holds stats and full listings.  See Config.Cache.
+	Cache *MetaCache
+	// Encryption, when set, encrypts uploads.  See Config.Encryption.
+	Encryption KeyProvider
+
+	ctx     context.Context
+	root    *AgileApi
+	session *session
+	// seeded is set when NewWithConfig made session, so it is read without
+	// taking sessionInit.
+	seeded bool
+}
+
+// Config holds everything NewWithConfig needs to build an AgileApi.
+type Config struct {
+	Username string
+	Password string
+	Url      string
+	Debug    bool
+	// TokenCache is the file the session token is cached in.  Defaults to ~/.agiletoken.
+	TokenCache string
+	// HTTPClient is used for all JSON-RPC calls, uploads and egress reads.  Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Logger receives all diagnostics.  Tokens and passwords are never
+	// logged.  Defaults to slog.Default(), with debug output sent to stderr
+	// when Debug is set.
+	Logger *slog.Logger
+	// Metrics is told about every JSON-RPC call, upload and egress read.
+	Metrics Metrics
+	// TracerProvider gets a span for every public method and HTTP round
+	// trip.  Defaults to otel.GetTracerProvider(), which does nothing unless
+	// the application installs one.
+	TracerProvider trace.TracerProvider
+	// Limits throttles JSON-RPC calls, uploads and downloads.  Everything
+	// made from this Config shares it.
+	Limits *Limits
+	// Cache keeps StatFile, ListAllFilesDetails and ListAllDirsDetails
+	// results.  Mutations made through the AgileApi invalidate it.
+	Cache *MetaCache
+	// Encryption encrypts everything uploaded with keys from the provider,
+	// and decrypts it again on File reads and Open.  Sizes and checksums
+	// Agile reports are of the ciphertext.
+	Encryption KeyProvider
 }
 
 type ListObject struct {
@@ -36,6 +97,8 @@ type ListResult struct {
 
 type ListFullResult struct {
 	Object []ListFullObject `json:"list"`
+	Code   int              `json:"code"`
+	Cookie int              `json:"cookie"`
 }
 
 type ListFullObject struct {
@@ -44,12 +107,13 @@ type ListFullObject struct {
 	Stat     FullStatResult `json:"stat"`
 }
 type FullStatResult struct {
-	Code   int    `json:"code"`
-	Mtime  int    `json:"mtime"`
-	Size   int    `json:"size"`
-	Type   int    `json:"type"`
-	Ctime  int    `json:"ctime"`
-	Sha256 string `json:"checksum"`
+	Code     int    `json:"code"`
+	Mtime    int    `json:"mtime"`
+	Size     int    `json:"size"`
+	Type     int    `json:"type"`
+	Ctime    int    `json:"ctime"`
+	Sha256   string `json:"checksum"`
+	MimeType string `json:"mimetype"`
 }
 
 type ListFullResponse struct {
@@ -86,7 +150,7 @@ type StatResponse struct {
 
 type AuthenticateResponse struct {
 	Code   int           `json:"code"`
-	Result []interface{} `json:result`
+	Result []interface{} `json:"result"`
 }
 
 type ActionResponse struct {
@@ -107,95 +171,149 @@ type NoOpResponse struct {
 
 //{"jsonrpc": "2.0", "id": 6183213937838991992, "result": {"code": -10001}}
 func New(username, password, url string, debug bool) *AgileApi {
-	usr, _ := user.Current()
-	dir := usr.HomeDir
+	me, err := NewWithConfig(Config{
+		Username: username,
+		Password: password,
+		Url:      url,
+		Debug:    debug,
+	})
+	if err != nil {
+		defaultLogger(debug).Error("Authentication Failed.  Exiting", "error", err)
+		os.Exit(1)
+	}
+	return me
+}
 
-	agiletokenfile := dir + "/.agiletoken"
-	_, err := os.Stat(agiletokenfile)
-	exists := false
+// NewWithConfig is like New but takes its settings from cfg and returns an
+// error instead of exiting when authentication fails.
+func NewWithConfig(cfg Config) (*AgileApi, error) {
+	agiletokenfile := cfg.TokenCache
+	if agiletokenfile == "" {
+		usr, _ := user.Current()
+		agiletokenfile = usr.HomeDir + "/.agiletoken"
+	}
+	me := &AgileApi{
+		Username:   cfg.Username,
+		Password:   cfg.Password,
+		Url:        cfg.Url,
+		Debug:      cfg.Debug,
+		Secure:     true,
+		TokenCache: agiletokenfile,
+		HTTPClient: cfg.HTTPClient,
+		Logger:     cfg.Logger,
+		Metrics:    cfg.Metrics,
+
+		TracerProvider: cfg.TracerProvider,
+		Limits:         cfg.Limits,
+		Cache:          cfg.Cache,
+		Encryption:     cfg.Encryption,
+
+		session: &session{},
+		seeded:  true,
+	}
+	tokenbyte, err := ioutil.ReadFile(agiletokenfile)
 	if err == nil {
-		exists = true
-	}
-	if exists {
-		tokenbyte, _ := ioutil.ReadFile(agiletokenfile)
-		mytoken := string(tokenbyte)
-
-		me := &AgileApi{
-			Username:   username,
-			Password:   password,
-			Token:      mytoken,
-			Url:        url,
-			Debug:      debug,
-			Secure:     true,
-			TokenCache: agiletokenfile,
-		}
-		if me.TestToken(mytoken, url) {
-			return me
+		me.Token = string(tokenbyte)
+		me.setToken(me.Token)
+		if me.TestToken(me.Token, me.Url) {
+			return me, nil
 		}
 	}
 	// If the saved token is no longer valid, do this.
-	mytoken, err := Authenticate(username, password, url, debug)
+	mytoken, err := authenticate(me.rpc(), me.Username, me.Password, me.Url)
 	if err != nil {
-		fmt.Println("Authentication Failed.  Trying Again. Error: ", err)
+		me.logger().Warn("Authentication Failed.  Trying Again.", "error", err)
+		me.metrics().Retry("login")
 
-		mytoken, err = Authenticate(username, password, url, debug)
+		mytoken, err = authenticate(me.rpc(), me.Username, me.Password, me.Url)
 		if err != nil {
-			log.Fatal("Authentication Failed.  Exiting")
+			return nil, err
 		}
 	}
+	me.Token = mytoken
+	me.setToken(mytoken)
 	err = ioutil.WriteFile(agiletokenfile, []byte(mytoken), 0644)
 	if err != nil {
-		fmt.Println("Can't write cache file")
+		me.logger().Warn("Can't write token cache file", "file", agiletokenfile, "error", err)
 	}
-	me := &AgileApi{
-		Username:   username,
-		Password:   password,
-		Url:        url,
-		Token:      mytoken,
-		Debug:      debug,
-		Secure:     true,
-		TokenCache: agiletokenfile,
-	}
-	return me
+	return me, nil
 }
 
 func (me *AgileApi) ReAuth() {
-	mytoken, err := Authenticate(me.Username, me.Password, me.Url, me.Debug)
+	me.reauth(me.token())
+}
+
+// reauth logs in again unless another caller already replaced stale while
+// this one waited.
+func (me *AgileApi) reauth(stale string) {
+	s := me.sharedSession()
+	s.login.Lock()
+	defer s.login.Unlock()
+	if me.token() != stale {
+		return
+	}
+	me, end := me.trace("ReAuth")
+	mytoken, err := authenticate(me.rpc(), me.Username, me.Password, me.Url)
+	end(&err)
+	me.metrics().ReAuth(err)
 	if err != nil {
-		fmt.Println("Auth Failed")
+		// Keep the old token, the failure may only be a cancelled context.
+		me.logger().Error("Auth Failed", "error", err)
+		return
 	}
-	me.Token = mytoken
+	me.setToken(mytoken)
 	err = ioutil.WriteFile(me.TokenCache, []byte(mytoken), 0644)
 	if err != nil {
-		fmt.Println("Can't write cacehfile")
+		me.logger().Warn("Can't write token cache file", "file", me.TokenCache, "error", err)
 	}
 	return
 }
 
 func Authenticate(username, password, url string, debug bool) (string, error) {
+	return authenticate(defaultRpc(debug), username, password, url)
+}
+
+func authenticate(c rpcClient, username, password, url string) (string, error) {
 	args := []interface{}{username, password, "true"}
-	output := jsonrpcCallNoDecode(url, "login", "POST", args, debug)
+	output, err := jsonrpcCallNoDecode(c, url, "login", "POST", args)
+	if err != nil {
+		return "", err
+	}
 	var dec AuthenticateResponse
-	err := json.Unmarshal([]byte(output), &dec)
+	err = json.Unmarshal([]byte(output), &dec)
 	if err != nil {
 		return "", err
 	}
-	if dec.Result[0].(string) == "" {
+	if len(dec.Result) == 0 {
 		return "", fmt.Errorf("Login Failed: %#v", dec)
 	}
-	return dec.Result[0].(string), nil
+	token, _ := dec.Result[0].(string)
+	if token == "" {
+		return "", fmt.Errorf("Login Failed: %#v", dec)
+	}
+	return token, nil
 }
 
-func jsonrpcCall(url, method, action string, args []interface{}, debug bool) (output []interface{}, err error) {
-	jsonstring := jsonrpcCallNoDecode(url, method, action, args, debug)
+func jsonrpcCall(c rpcClient, url, method, action string, args []interface{}) (output []interface{}, err error) {
+	jsonstring, err := jsonrpcCallNoDecode(c, url, method, action, args)
+	if err != nil {
+		return
+	}
 	err = json.Unmarshal([]byte(jsonstring), &output)
 	return
 }
 
 func DoAction(url, method, action string, args []interface{}, debug bool) error {
-	outputjson := jsonrpcCallNoDecode(url, method, action, args, debug)
+	return doAction(defaultRpc(debug), url, method, action, args)
+}
+
+func doAction(c rpcClient, url, method, action string, args []interface{}) error {
+	outputjson, err := jsonrpcCallNoDecode(c, url, method, action, args)
+	if err != nil {
+		return err
+	}
 	var dec ActionResponse
-	err := json.Unmarshal([]byte(outputjson), &dec)
+	err = json.Unmarshal([]byte(outputjson), &dec)
 	if err != nil {
 		return err
 	}
@@ -209,175 +327,296 @@ func DoAction(url, method, action string, args []interface{}, debug bool) error
 }
 
 func (me *AgileApi) CheckAuth() {
-	if !me.TestToken(me.Token, me.Url) {
-		me.ReAuth()
+	me, end := me.trace("CheckAuth")
+	defer end(nil)
+	token := me.token()
+	if !me.TestToken(token, me.Url) {
+		me.reauth(token)
 	}
 }
 
 func (me *AgileApi) TestToken(token, url string) (output bool) {
-	me.writedebug("Testing Token")
+	me, end := me.trace("TestToken")
+	defer end(nil)
+	me.logger().Debug("Testing Token")
 
 	args := []interface{}{token}
-	outputf := jsonrpcCallNoDecode(url, "noop", "POST", args, me.Debug)
+	outputf, err := jsonrpcCallNoDecode(me.rpc(), url, "noop", "POST", args)
+	if err != nil {
+		return false
+	}
 	var dec NoOpResponse
-	err := json.Unmarshal([]byte(outputf), &dec)
+	err = json.Unmarshal([]byte(outputf), &dec)
 	if err != nil {
 		return false
 	}
 	if dec.Result.Code == 0 {
-		me.writedebug("Cached Credentials still valid.  Using.")
+		me.logger().Debug("Cached Credentials still valid.  Using.")
 		return true
 	}
-	me.writedebug("Cached Credentials are not valid.")
+	me.logger().Debug("Cached Credentials are not valid.")
 	return false
 }
 
-func (me *AgileApi) SetMTime(path, mtime string) error {
+func (me *AgileApi) SetMTime(path, mtime string) (err error) {
+	me, end := me.trace("SetMTime", pathAttr(path))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
+	me.CheckAuth()
+	args := []interface{}{me.token(), path, mtime}
+	err = me.doAction("setMTime", args)
+	return err
+}
+
+func (me *AgileApi) RenameFile(originpath, destpath string) (err error) {
+	me, end := me.trace("RenameFile", pathAttr(originpath), attribute.String("agile.destination", destpath))
+	defer end(&err)
+	defer me.Cache.invalidate(destpath)
+	defer me.Cache.invalidate(originpath)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path, mtime}
-	err := DoAction(me.Url, "setMTime", "POST", args, me.Debug)
+	args := []interface{}{me.token(), originpath, destpath}
+	err = me.doAction("renameFile", args)
 	return err
 }
 
-func (me *AgileApi) RenameFile(originpath, destpath string) error {
+func (me *AgileApi) RmFile(path string) (err error) {
+	me, end := me.trace("RmFile", pathAttr(path))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
 	me.CheckAuth()
-	args := []interface{}{me.Token, originpath, destpath}
-	err := DoAction(me.Url, "renameFile", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	err = me.doAction("deleteFile", args)
 	return err
 }
 
-func (me *AgileApi) RmFile(path string) error {
+func (me *AgileApi) RmDir(path string) (err error) {
+	me, end := me.trace("RmDir", pathAttr(path))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	err := DoAction(me.Url, "deleteFile", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	err = me.doAction("deleteDir", args)
 	return err
 }
 
-func (me *AgileApi) RmDir(path string) error {
+func (me *AgileApi) MkDir2(path string) (err error) {
+	me, end := me.trace("MkDir2", pathAttr(path))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	err := DoAction(me.Url, "deleteDir", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	err = me.doAction("makeDir2", args)
 	return err
 }
 
-func (me *AgileApi) MkDir2(path string) error {
+func (me *AgileApi) MkDir(path string) (err error) {
+	me, end := me.trace("MkDir", pathAttr(path))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	err := DoAction(me.Url, "makeDir2", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	err = me.doAction("makeDir", args)
 	return err
 }
 
-func (me *AgileApi) MkDir(path string) error {
+func (me *AgileApi) SetContentType(path, mimetype string) (err error) {
+	me, end := me.trace("SetContentType", pathAttr(path), attribute.String("agile.mimetype", mimetype))
+	defer end(&err)
+	defer me.Cache.invalidate(path)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	err := DoAction(me.Url, "makeDir", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path, mimetype}
+	err = me.doAction("setContentType", args)
 	return err
 }
 
 func (me *AgileApi) StatFile(path string) (output StatResult, err error) {
+	me, end := me.trace("StatFile", pathAttr(path))
+	defer end(&err)
+	if cached, ok := me.Cache.get("stat", path); ok {
+		return cached.(StatResult), nil
+	}
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	outputjson := jsonrpcCallNoDecode(me.Url, "stat", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	outputjson, err := me.call("stat", args)
+	if err != nil {
+		return
+	}
 	var dec StatResponse
 	err = json.Unmarshal([]byte(outputjson), &dec)
 	if err != nil {
 		return
 	}
 	output = dec.Result
+	// Only answers are kept, an error code like an expired token would
+	// otherwise stick until the entry expires.
+	if output.Code == 0 || output.Code == codeNotFound {
+		me.Cache.put("stat", path, output)
+	}
+	me.annotate(attribute.Int("agile.code", output.Code), attribute.Int("agile.size", output.Size))
 	return
 }
 
+// ListAllFilesDetails lists every file in path with stat details.  A
+// listing that fails part way is logged and what was read returned, see
+// ListFilesDetails for the error.
 func (me *AgileApi) ListAllFilesDetails(path string) (output []ListFullObject) {
+	output, _ = me.ListFilesDetails(path)
+	return
+}
+
+// ListFilesDetails is ListAllFilesDetails returning the error that cut the
+// listing short.
+func (me *AgileApi) ListFilesDetails(path string) (output []ListFullObject, err error) {
+	me, end := me.trace("ListFilesDetails", pathAttr(path))
+	defer end(&err)
+	return me.listAllDetails("listFile", path)
+}
+
+// ListFilesPage returns up to pagesize files in path, with stat details,
+// starting at cookie.  The returned cookie continues the listing and is 0
+// once the last page has been read.
+func (me *AgileApi) ListFilesPage(path string, pagesize, cookie int) (output []ListFullObject, next int, err error) {
+	me, end := me.trace("ListFilesPage", pathAttr(path))
+	defer end(&err)
+	return me.listPage("listFile", path, pagesize, cookie)
+}
+
+// ListDirsPage is ListFilesPage for directories.
+func (me *AgileApi) ListDirsPage(path string, pagesize, cookie int) (output []ListFullObject, next int, err error) {
+	me, end := me.trace("ListDirsPage", pathAttr(path))
+	defer end(&err)
+	return me.listPage("listDir", path, pagesize, cookie)
+}
+
+func (me *AgileApi) listAllDetails(method, path string) (output []ListFullObject, err error) {
+	if cached, ok := me.Cache.get(method, path); ok {
+		return append([]ListFullObject(nil), cached.([]ListFullObject)...), nil
+	}
 	pagesize := 10000
-	pageoffset := 0
-	includestat := true
-	mylen := 1
-	for mylen >= 0 {
-		me.CheckAuth()
-		args := []interface{}{me.Token, path, pagesize, pageoffset, includestat}
-		outputjson := jsonrpcCallNoDecode(me.Url, "listFile", "POST", args, me.Debug)
-		var dec ListFullResponse
-		err := json.Unmarshal([]byte(outputjson), &dec)
+	cookie := 0
+	for {
+		page, next, err := me.listPage(method, path, pagesize, cookie)
 		if err != nil {
-			fmt.Println(err)
-
+			me.logger().Error("listing failed", "method", method, "path", path, "error", err)
+			return output, err
 		}
-		loutput := dec.Result.Object
-		mylen = len(loutput)
-		output = append(output, loutput[:mylen]...)
-		pageoffset = dec.Cookie
-		if pageoffset == 0 {
-			mylen = -1
+		output = append(output, page...)
+		if next == 0 || len(page) == 0 {
+			me.Cache.put(method, path, append([]ListFullObject(nil), output...))
+			return output, nil
 		}
+		cookie = next
 	}
-	return
+}
 
+// listPage reads one page of a listing in a span of its own.
+func (me *AgileApi) listPage(method, path string, pagesize, cookie int) (output []ListFullObject, next int, err error) {
+	ctx, span := me.tracer().Start(me.context(), "agile.page", trace.WithAttributes(
+		attribute.String("agile.method", method),
+		pathAttr(path),
+		attribute.Int("agile.cookie", cookie),
+		attribute.Int("agile.pagesize", pagesize),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("agile.count", len(output)))
+		endSpan(span, err)
+	}()
+	me = me.WithContext(ctx)
+	me.CheckAuth()
+	includestat := true
+	args := []interface{}{me.token(), path, pagesize, cookie, includestat}
+	outputjson, err := me.call(method, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dec ListFullResponse
+	err = json.Unmarshal([]byte(outputjson), &dec)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dec.Result.Code != 0 {
+		return nil, 0, listError(path, dec.Result.Code)
+	}
+	next = dec.Result.Cookie
+	if next == 0 {
+		next = dec.Cookie
+	}
+	return dec.Result.Object, next, nil
 }
 
 func (me *AgileApi) ListFiles(path string) (output []ListObject) {
+	me, end := me.trace("ListFiles", pathAttr(path))
+	defer end(nil)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	fmt.Println(args)
-	outputjson := jsonrpcCallNoDecode(me.Url, "listFile", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	outputjson, err := me.call("listFile", args)
+	if err != nil {
+		me.logger().Error("listing failed", "method", "listFile", "path", path, "error", err)
+		return
+	}
 	var dec ListResponse
-	err := json.Unmarshal([]byte(outputjson), &dec)
+	err = json.Unmarshal([]byte(outputjson), &dec)
 	if err != nil {
-		fmt.Println(err)
+		me.logger().Error("bad listing response", "method", "listFile", "path", path, "error", err)
 	}
 	output = dec.Result.Object
 	return
 }
 
 func (me *AgileApi) ListDirs(path string) (output []ListObject) {
+	me, end := me.trace("ListDirs", pathAttr(path))
+	defer end(nil)
 	me.CheckAuth()
-	args := []interface{}{me.Token, path}
-	outputjson := jsonrpcCallNoDecode(me.Url, "listDir", "POST", args, me.Debug)
+	args := []interface{}{me.token(), path}
+	outputjson, err := me.call("listDir", args)
+	if err != nil {
+		me.logger().Error("listing failed", "method", "listDir", "path", path, "error", err)
+		return
+	}
 	var dec ListResponse
-	err := json.Unmarshal([]byte(outputjson), &dec)
+	err = json.Unmarshal([]byte(outputjson), &dec)
 	if err != nil {
-		fmt.Println(err)
+		me.logger().Error("bad listing response", "method", "listDir", "path", path, "error", err)
 	}
 	output = dec.Result.Object
 	return
 }
 
 func (me *AgileApi) ListAllDirsDetails(path string) (output []ListFullObject) {
-	pagesize := 10000
-	pageoffset := 0
-	includestat := true
-	mylen := 1
-	for mylen >= 0 {
-		me.CheckAuth()
-		args := []interface{}{me.Token, path, pagesize, pageoffset, includestat}
-		outputjson := jsonrpcCallNoDecode(me.Url, "listDir", "POST", args, me.Debug)
-		var dec ListFullResponse
-		err := json.Unmarshal([]byte(outputjson), &dec)
-		if err != nil {
-			fmt.Println(err)
-		}
-		loutput := dec.Result.Object
-		mylen = len(loutput)
-		output = append(output, loutput[:mylen]...)
-		pageoffset = dec.Cookie
-		if pageoffset == 0 {
-			mylen = -1
-		}
-
-	}
+	output, _ = me.ListDirsDetails(path)
 	return
+}
 
+// ListDirsDetails is ListFilesDetails for directories.
+func (me *AgileApi) ListDirsDetails(path string) (output []ListFullObject, err error) {
+	me, end := me.trace("ListDirsDetails", pathAttr(path))
+	defer end(&err)
+	return me.listAllDetails("listDir", path)
 }
 
-func (me *AgileApi) UploadFileStream(path, file string, filereader io.Reader) (err error) {
-	me.CheckAuth()
-	params := map[string]string{
-		"X-Agile-Authorization":  me.Token,
-		"X-Agile-Directory":      path,
-		"X-Agile-Basename":       file,
-		"X-Agile-Expose-Egress":  "COMPLETE",
-		"X-Agile-Content-Detect": "auto",
-		"X-Agile-Recursive":      "true",
+func (me *AgileApi) UploadFileStream(path, file string, filereader io.Reader) error {
+	return me.UploadFileStreamWithOptions(path, file, filereader, nil)
+}
+
+// UploadFileStreamWithOptions is UploadFileStream with control over how the
+// file is stored.  opts may be nil.
+func (me *AgileApi) UploadFileStreamWithOptions(path, file string, filereader io.Reader, opts *UploadOptions) (err error) {
+	me, end := me.trace("UploadFileStream", pathAttr(path+file))
+	defer end(&err)
+	file = opts.storedName(file)
+	mypath := cachePath(path + "/" + file)
+	defer me.Cache.invalidate(mypath)
+	filereader, opts, err = me.prepareUpload(file, filereader, opts)
+	if err != nil {
+		return err
 	}
+	contenttype := opts.ContentType
+	err = opts.before(me, mypath)
+	if err != nil {
+		return err
+	}
+	me.CheckAuth()
+	params := opts.headers(me.token(), path, file, contenttype)
 	urlbits := strings.Split(me.Url, "/")
 	host := urlbits[2]
 	uri_template := "https://%s/post/raw"
@@ -385,64 +624,173 @@ func (me *AgileApi) UploadFileStream(path, file string, filereader io.Reader) (e
 		uri_template = "http://%s:8080/post/raw"
 	}
 	uri := fmt.Sprintf(uri_template, host)
-	client := &http.Client{}
-
 	req, _ := http.NewRequest("POST", uri, filereader)
+	req, span := roundTrip(me.context(), me.tracer(), "agile.upload", req, pathAttr(path+file))
+	counter := &countingReader{}
+	if req.Body != nil {
+		counter.r = me.Limits.uploadReader(me.context(), req.Body)
+		req.Body = ioutil.NopCloser(counter)
+	}
 	for k, v := range params {
 		req.Header.Add(k, v)
 	}
-	resp, err := client.Do(req)
+	start := time.Now()
+	stats := RequestStats{Kind: "upload", Method: "upload"}
+	defer func() {
+		stats.Duration = time.Since(start)
+		stats.BytesOut = counter.n
+		stats.Err = err
+		me.metrics().Request(stats)
+		span.SetAttributes(attribute.Int64("agile.size", counter.n), attribute.Int("http.status_code", stats.Status))
+		endSpan(span, err)
+	}()
+	release, err := me.Limits.acquire(me.context())
 	if err != nil {
 		return err
 	}
+	resp, err := me.client().Do(req)
+	if err != nil {
+		release()
+		me.logger().Debug("upload failed", "method", "upload", "path", path+file, "duration", time.Since(start), "error", err)
+		return err
+	}
+	resp.Body.Close()
+	// opts.after makes calls of its own, which need a slot too.
+	release()
+	stats.Status = resp.StatusCode
+	me.logger().Debug("upload", "method", "upload", "path", path+file, "duration", time.Since(start), "status", resp.StatusCode)
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("PostRawFail: %d", resp.StatusCode)
+		err = fmt.Errorf("PostRawFail: %d", resp.StatusCode)
+		return err
 	}
-	return nil
+	err = opts.after(me, mypath)
+	return err
 }
 
 func (me *AgileApi) UploadFile(path, file, localfilepath string, progress bool) (err error) {
+	return me.UploadFileWithOptions(path, file, localfilepath, progress, nil)
+}
+
+func (me *AgileApi) UploadFileWithOptions(path, file, localfilepath string, progress bool, opts *UploadOptions) (err error) {
+	me, end := me.trace("UploadFile", pathAttr(path+file))
+	defer end(&err)
 	data, err := os.Open(localfilepath)
-	err = me.UploadFileStream(path, file, data)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	err = me.UploadFileStreamWithOptions(path, file, data, opts)
 	return err
 }
 
-func jsonrpcCallNoDecode(url, method, action string, args []interface{}, debug bool) (output string) {
+// call runs a JSON-RPC method against the api endpoint using the configured client.
+func (me *AgileApi) call(method string, args []interface{}) (string, error) {
+	return jsonrpcCallNoDecode(me.rpc(), me.Url, method, "POST", args)
+}
 
-	message, err := json2.EncodeClientRequest(method, args)
-	if err != nil {
-		log.Fatalf("%s", err)
+func (me *AgileApi) doAction(method string, args []interface{}) error {
+	return doAction(me.rpc(), me.Url, method, "POST", args)
+}
+
+// rpcClient carries what every JSON-RPC call needs.
+type rpcClient struct {
+	ctx     context.Context
+	limits  *Limits
+	http    *http.Client
+	logger  *slog.Logger
+	metrics Metrics
+	tracer  trace.Tracer
+}
 
+func (me *AgileApi) rpc() rpcClient {
+	return rpcClient{
+		ctx:     me.context(),
+		http:    me.client(),
+		logger:  me.logger(),
+		limits:  me.Limits,
+		metrics: me.metrics(),
+		tracer:  me.tracer(),
 	}
-	if debug {
-		fmt.Println(string(message))
+}
 
+// defaultRpc is used by the package level helpers that predate AgileApi.
+func defaultRpc(debug bool) rpcClient {
+	return rpcClient{
+		ctx:     context.Background(),
+		http:    http.DefaultClient,
+		logger:  defaultLogger(debug),
+		metrics: noMetrics{},
+		tracer:  otel.GetTracerProvider().Tracer(tracerName),
+	}
+}
+
+func (me *AgileApi) client() *http.Client {
+	if me.HTTPClient != nil {
+		return me.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func jsonrpcCallNoDecode(c rpcClient, url, method, action string, args []interface{}) (string, error) {
+	message, err := json2.EncodeClientRequest(method, args)
+	if err != nil {
+		return "", err
+	}
+	path, _ := rpcPath(method, args)
+	output, err := c.post(url, action, method, path, message)
+	return string(output), err
+}
+
+// post sends an encoded JSON-RPC message, which may be a batch, and returns
+// the raw response.  method and path only describe the call for logs,
+// metrics and traces.
+func (c rpcClient) post(url, action, method, path string, message []byte) (output []byte, err error) {
+	start := time.Now()
+	attrs := []interface{}{"method", method}
+	spanattrs := []attribute.KeyValue{attribute.String("agile.method", method)}
+	if path != "" {
+		attrs = append(attrs, "path", path)
+		spanattrs = append(spanattrs, pathAttr(path))
 	}
 	req, err := http.NewRequest(action, url, bytes.NewBuffer(message))
 	if err != nil {
-		log.Fatalf("%s", err)
-
+		return nil, err
 	}
+	req, span := roundTrip(c.ctx, c.tracer, "agile.rpc "+method, req, spanattrs...)
+	stats := RequestStats{Kind: "rpc", Method: method, BytesOut: int64(len(message))}
+	defer func() {
+		stats.Duration = time.Since(start)
+		stats.Err = err
+		c.metrics.Request(stats)
+		span.SetAttributes(attribute.Int("http.status_code", stats.Status), attribute.Int("agile.code", stats.Code))
+		endSpan(span, err)
+	}()
 	req.Header.Set("Content-Type", "application/json")
-	client := new(http.Client)
-	resp, err := client.Do(req)
+	release, err := c.limits.call(c.ctx)
 	if err != nil {
-		log.Fatalf("Error in sending request to %s. %s", url, err)
-
+		return nil, err
+	}
+	defer release()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.logger.Debug("jsonrpc call failed", append(attrs, "duration", time.Since(start), "error", err)...)
+		return nil, fmt.Errorf("Error in sending request to %s. %s", url, err)
 	}
 	defer resp.Body.Close()
-	outputbs, err := ioutil.ReadAll(resp.Body)
-	output = string(outputbs)
+	stats.Status = resp.StatusCode
+	output, err = ioutil.ReadAll(resp.Body)
+	stats.BytesIn = int64(len(output))
 	if err != nil {
-		log.Fatalf("Error reading response %s", output)
+		c.logger.Debug("jsonrpc call failed", append(attrs, "duration", time.Since(start), "status", resp.StatusCode, "error", err)...)
+		return nil, fmt.Errorf("Error reading response %s", output)
 	}
-	return
-}
-
-func (me *AgileApi) writedebug(message string) {
-	if me.Debug {
-		log.Println("DEBUG - AgileAPI - " + message)
+	attrs = append(attrs, "duration", time.Since(start), "status", resp.StatusCode)
+	if code, ok := resultCode(output); ok {
+		stats.Code = code
+		attrs = append(attrs, "code", code)
 	}
+	c.logger.Debug("jsonrpc call", attrs...)
+	return output, nil
 }
 
 /*
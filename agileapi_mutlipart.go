@@ -1,17 +1,14 @@
 package agileapi
 
-import "log"
-
 func (me *AgileApi) CreateMultipart(path, file string) (err error) {
+	return me.CreateMultipartWithOptions(path, file, nil)
+}
+
+func (me *AgileApi) CreateMultipartWithOptions(path, file string, opts *UploadOptions) (err error) {
+	me, end := me.trace("CreateMultipart", pathAttr(path+file))
+	defer end(&err)
 	me.CheckAuth()
-	params := map[string]string{
-		"X-Agile-Authorization":  me.Token,
-		"X-Agile-Directory":      path,
-		"X-Agile-Basename":       file,
-		"X-Agile-Expose-Egress":  "COMPLETE",
-		"X-Agile-Content-Detect": "auto",
-		"X-Agile-Recursive":      "true",
-	}
-	log.Println(params)
+	params := opts.headers(me.token(), path, file, "")
+	me.logger().Debug("CreateMultipart", "path", path+file, "recursive", params["X-Agile-Recursive"])
 	return nil
 }
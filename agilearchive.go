@@ -0,0 +1,428 @@
+package agileapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Archive formats for ExtractTo and ArchiveTo.
+const (
+	ArchiveTar     = "tar"
+	ArchiveTarGz   = "tar.gz"
+	ArchiveTarZstd = "tar.zst"
+	ArchiveZip     = "zip"
+)
+
+type ExtractOptions struct {
+	// Concurrency is how many entries upload at once.  Defaults to 4.
+	Concurrency int
+	// MaxBuffered is the largest tar entry held in memory so it can upload
+	// alongside others; bigger ones stream from the archive one at a time.
+	// Defaults to 8MB.  Zip entries are always read in parallel.
+	MaxBuffered int64
+	// Upload is used for every file.  Its Mtime is replaced by the entry's.
+	Upload *UploadOptions
+}
+
+// ExtractResult is the outcome of one archive entry.
+type ExtractResult struct {
+	// Name is the entry's name in the archive and Path where it went.
+	Name    string
+	Path    string
+	Size    int64
+	IsDir   bool
+	Skipped bool
+	Err     error
+}
+
+// ExtractTo uploads the files in archive under remoteDir, keeping their
+// mtimes.  Entries that would land outside remoteDir fail, and links and
+// other special entries are skipped.  Each entry gets a result, in archive
+// order; the error is only set when the archive itself couldn't be read or
+// ctx was cancelled.
+func (me *AgileFiles) ExtractTo(ctx context.Context, archive io.Reader, format, remoteDir string, opts *ExtractOptions) (_ []ExtractResult, err error) {
+	me, end := me.WithContext(ctx).trace("ExtractTo", pathAttr(remoteDir), attribute.String("agile.format", format))
+	defer end(&err)
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	x := &extractor{
+		af:    me,
+		ctx:   ctx,
+		dir:   remoteDir,
+		opts:  opts,
+		slots: make(chan struct{}, concurrency),
+	}
+	switch format {
+	case ArchiveTar:
+		err = x.tar(archive)
+	case ArchiveTarGz:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(archive)
+		if err == nil {
+			err = x.tar(zr)
+		}
+	case ArchiveTarZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(archive, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			err = x.tar(zr)
+			zr.Close()
+		}
+	case ArchiveZip:
+		err = x.zip(archive)
+	default:
+		err = fmt.Errorf("agileapi: unknown archive format %q", format)
+	}
+	x.wg.Wait()
+	// Set last, as uploading into a directory changes its mtime.
+	for i := range x.results {
+		result := &x.results[i]
+		if result.IsDir && result.Err == nil && !x.mtimes[i].IsZero() {
+			result.Err = me.SetMtime(result.Path, x.mtimes[i])
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return x.results, err
+}
+
+type extractor struct {
+	af      *AgileFiles
+	ctx     context.Context
+	dir     string
+	opts    *ExtractOptions
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	results []ExtractResult
+	mtimes  []time.Time
+}
+
+// archiveTarget is where name goes under dir, refusing names that are
+// absolute or climb out with "..", and files named "" or "." that would
+// land on dir itself.  Directories named that way, like tar's "./", are dir.
+func archiveTarget(dir, name string, isdir bool) (string, error) {
+	clean := strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(clean) {
+		return "", fmt.Errorf("agileapi: archive entry %q is absolute", name)
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("agileapi: archive entry %q is outside the target", name)
+		}
+	}
+	if !isdir && path.Clean("/"+clean) == "/" {
+		return "", fmt.Errorf("agileapi: archive entry %q has no name", name)
+	}
+	return path.Join(dir, clean), nil
+}
+
+func (me *extractor) add(result ExtractResult, mtime time.Time) int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.results = append(me.results, result)
+	me.mtimes = append(me.mtimes, mtime)
+	return len(me.results) - 1
+}
+
+func (me *extractor) fail(i int, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.results[i].Err = err
+}
+
+// entry handles one archive entry.  Files are uploaded in the background
+// when async is set, else before entry returns.
+func (me *extractor) entry(name string, mode fs.FileMode, size int64, mtime time.Time, open func() (io.ReadCloser, error), async bool) error {
+	target, err := archiveTarget(me.dir, name, mode.IsDir())
+	skipped := !mode.IsDir() && !mode.IsRegular()
+	i := me.add(ExtractResult{Name: name, Path: target, Size: size, IsDir: mode.IsDir(), Skipped: skipped, Err: err}, mtime)
+	if err != nil || skipped {
+		return nil
+	}
+	if mode.IsDir() {
+		me.fail(i, me.af.Mkdir(target))
+		return nil
+	}
+	select {
+	case me.slots <- struct{}{}:
+	case <-me.ctx.Done():
+		me.fail(i, me.ctx.Err())
+		return me.ctx.Err()
+	}
+	upload := func() {
+		defer func() { <-me.slots }()
+		data, err := open()
+		if err != nil {
+			me.fail(i, err)
+			return
+		}
+		defer data.Close()
+		var opts UploadOptions
+		if me.opts.Upload != nil {
+			opts = *me.opts.Upload
+		}
+		opts.Mtime = mtime
+		me.fail(i, me.af.PutWithOptions(target, data, &opts))
+	}
+	if !async {
+		upload()
+		return nil
+	}
+	me.wg.Add(1)
+	go func() {
+		defer me.wg.Done()
+		upload()
+	}()
+	return nil
+}
+
+func (me *extractor) tar(archive io.Reader) error {
+	maxbuffered := me.opts.MaxBuffered
+	if maxbuffered <= 0 {
+		maxbuffered = 8 << 20
+	}
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if me.ctx.Err() != nil {
+			return me.ctx.Err()
+		}
+		mode := header.FileInfo().Mode()
+		if !mode.IsRegular() || header.Size > maxbuffered {
+			err = me.entry(header.Name, mode, header.Size, header.ModTime, func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			}, false)
+		} else {
+			data, rerr := io.ReadAll(tr)
+			if rerr != nil {
+				return rerr
+			}
+			err = me.entry(header.Name, mode, header.Size, header.ModTime, func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(data)), nil
+			}, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// zip needs random access, so archives that aren't already seekable are
+// spooled to a temp file first.
+func (me *extractor) zip(archive io.Reader) error {
+	readerat, ok := archive.(io.ReaderAt)
+	seeker, seekable := archive.(io.Seeker)
+	if !ok || !seekable {
+		tmp, err := os.CreateTemp("", "agile-extract-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		_, err = io.Copy(tmp, archive)
+		if err != nil {
+			return err
+		}
+		readerat, seeker = tmp, tmp
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(readerat, size)
+	if err != nil {
+		return err
+	}
+	// Entries read the archive in the background, so it has to outlive them.
+	defer me.wg.Wait()
+	for _, file := range zr.File {
+		if me.ctx.Err() != nil {
+			return me.ctx.Err()
+		}
+		err = me.entry(file.Name, file.Mode(), int64(file.UncompressedSize64), file.Modified, file.Open, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ArchiveOptions struct {
+	// Manifest adds a sha256sum style list of every file as the last entry,
+	// named ManifestName or SHA256SUMS.
+	Manifest     bool
+	ManifestName string
+}
+
+// ArchiveTo writes the tree under remoteDir to w as an archive, reading
+// each file from egress as it goes.
+func (me *AgileFiles) ArchiveTo(ctx context.Context, remoteDir string, w io.Writer, format string) error {
+	return me.ArchiveToWithOptions(ctx, remoteDir, w, format, nil)
+}
+
+// ArchiveToWithOptions is ArchiveTo with an optional manifest.  Files are
+// checked against the checksums in the listing, which the manifest is made
+// from, as they are read.
+func (me *AgileFiles) ArchiveToWithOptions(ctx context.Context, remoteDir string, w io.Writer, format string, opts *ArchiveOptions) (err error) {
+	me, end := me.WithContext(ctx).trace("ArchiveTo", pathAttr(remoteDir), attribute.String("agile.format", format))
+	defer end(&err)
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	root := path.Clean(remoteDir)
+	var manifest bytes.Buffer
+	err = Walk(me, root, func(mypath string, file Filestruct, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := strings.TrimPrefix(mypath[len(root):], "/")
+		if file.IsDir {
+			return aw.dir(name, file.Mtime)
+		}
+		sha, err := me.archiveFile(aw, mypath, name, file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sha, name)
+		return nil
+	})
+	if err == nil && opts.Manifest {
+		name := opts.ManifestName
+		if name == "" {
+			name = "SHA256SUMS"
+		}
+		err = aw.file(name, time.Now(), int64(manifest.Len()), &manifest)
+	}
+	cerr := aw.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// archiveFile streams one file into aw and returns its sha256.
+func (me *AgileFiles) archiveFile(aw *archiveWriter, mypath, name string, file Filestruct) (string, error) {
+	body, err := me.Open(mypath)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	err = aw.file(name, file.Mtime, int64(file.Size), io.TeeReader(body, hash))
+	if err != nil {
+		return "", err
+	}
+	sha := hex.EncodeToString(hash.Sum(nil))
+	if file.Sha256 != "" && file.Sha256 != sha {
+		return "", &ChecksumError{Path: mypath, Local: sha, Remote: file.Sha256}
+	}
+	return sha, nil
+}
+
+// archiveWriter writes entries to a tar or zip archive.
+type archiveWriter struct {
+	tw         *tar.Writer
+	zw         *zip.Writer
+	compressor io.WriteCloser
+}
+
+func newArchiveWriter(w io.Writer, format string) (*archiveWriter, error) {
+	me := &archiveWriter{}
+	var err error
+	switch format {
+	case ArchiveTar:
+	case ArchiveTarGz:
+		me.compressor = gzip.NewWriter(w)
+	case ArchiveTarZstd:
+		me.compressor, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case ArchiveZip:
+		me.zw = zip.NewWriter(w)
+		return me, nil
+	default:
+		err = fmt.Errorf("agileapi: unknown archive format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if me.compressor != nil {
+		w = me.compressor
+	}
+	me.tw = tar.NewWriter(w)
+	return me, nil
+}
+
+func (me *archiveWriter) dir(name string, mtime time.Time) error {
+	if me.zw != nil {
+		_, err := me.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: mtime})
+		return err
+	}
+	return me.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: mtime})
+}
+
+func (me *archiveWriter) file(name string, mtime time.Time, size int64, data io.Reader) error {
+	var w io.Writer
+	var err error
+	if me.zw != nil {
+		w, err = me.zw.CreateHeader(&zip.FileHeader{Name: name, Modified: mtime, Method: zip.Deflate})
+	} else {
+		err = me.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: mtime})
+		w = me.tw
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, data)
+	if err == nil && me.tw != nil && n != size {
+		err = fmt.Errorf("agileapi: %s was %d bytes, listed as %d", name, n, size)
+	}
+	return err
+}
+
+func (me *archiveWriter) Close() error {
+	if me.zw != nil {
+		return me.zw.Close()
+	}
+	err := me.tw.Close()
+	if me.compressor != nil {
+		if cerr := me.compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
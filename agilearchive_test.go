@@ -0,0 +1,260 @@
+package agileapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		isdir bool
+		want  string
+	}{
+		{"a.txt", false, "/dst/a.txt"},
+		{"a/b.txt", false, "/dst/a/b.txt"},
+		{"./a/./b.txt", false, "/dst/a/b.txt"},
+		{`a\b.txt`, false, "/dst/a/b.txt"},
+		{"a/", true, "/dst/a"},
+		{"./", true, "/dst"},
+		{"", true, "/dst"},
+		{"../x", false, ""},
+		{"/abs", false, ""},
+		{`\abs`, false, ""},
+		{"a/../../x", false, ""},
+		{"a/../x", false, ""},
+		{`a\..\x`, false, ""},
+		{"..", true, ""},
+		{"", false, ""},
+		{".", false, ""},
+		{"./", false, ""},
+	} {
+		got, err := archiveTarget("/dst", tc.name, tc.isdir)
+		if tc.want == "" && err == nil {
+			t.Errorf("archiveTarget(%q) = %q, want an error", tc.name, got)
+		}
+		if tc.want != "" && (err != nil || got != tc.want) {
+			t.Errorf("archiveTarget(%q) = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	files := map[string]string{"/a.txt": "alpha", "/sub/b.bin": "\x00\x01beta", "/sub/deeper/c": ""}
+	for _, format := range []string{ArchiveTar, ArchiveTarGz, ArchiveTarZstd, ArchiveZip} {
+		stub := newStubAgile(t)
+		af := stub.agileFiles(stub.api())
+		for name, data := range files {
+			stub.Put("/src"+name, []byte(data))
+		}
+		var archive bytes.Buffer
+		err := af.ArchiveToWithOptions(context.Background(), "/src", &archive, format, &ArchiveOptions{Manifest: true})
+		if err != nil {
+			t.Fatalf("%s: ArchiveTo: %s", format, err)
+		}
+		results, err := af.ExtractTo(context.Background(), bytes.NewReader(archive.Bytes()), format, "/dst", nil)
+		if err != nil {
+			t.Fatalf("%s: ExtractTo: %s", format, err)
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				t.Errorf("%s: %s: %s", format, result.Name, result.Err)
+			}
+		}
+		for name, data := range files {
+			if got, ok := stub.Contents("/dst" + name); !ok || string(got) != data {
+				t.Errorf("%s: %s extracted as %q, %v", format, name, got, ok)
+			}
+		}
+		if _, ok := stub.Contents("/dst/SHA256SUMS"); !ok {
+			t.Errorf("%s: no manifest", format)
+		}
+	}
+}
+
+var hostileNames = []string{"../x", "/abs", "a/../../x", `a\..\x`, "", "."}
+
+func TestExtractTarRefusesHostileNames(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range append(hostileNames, "ok") {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	checkHostileExtract(t, ArchiveTar, archive.Bytes())
+}
+
+func TestExtractZipRefusesHostileNames(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range append(hostileNames, "ok") {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+	}
+	zw.Close()
+	checkHostileExtract(t, ArchiveZip, archive.Bytes())
+}
+
+func checkHostileExtract(t *testing.T, format string, archive []byte) {
+	t.Helper()
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	stub.Put("/dst/keep", []byte("keep"))
+	results, err := af.ExtractTo(context.Background(), bytes.NewReader(archive), format, "/dst", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(hostileNames)+1 {
+		t.Fatalf("%d results, want %d", len(results), len(hostileNames)+1)
+	}
+	for _, result := range results[:len(hostileNames)] {
+		if result.Err == nil {
+			t.Errorf("%q extracted to %q", result.Name, result.Path)
+		}
+	}
+	if last := results[len(results)-1]; last.Err != nil {
+		t.Errorf("ok: %s", last.Err)
+	}
+	paths := stub.Paths()
+	if len(paths) != 2 || paths[0] != "/dst/keep" || paths[1] != "/dst/ok" {
+		t.Errorf("stored %q, want only /dst/keep and /dst/ok", paths)
+	}
+}
+
+// archivedTree puts a small tree under /src with known mtimes.
+func archivedTree(stub *stubAgile) map[string]time.Time {
+	mtimes := map[string]time.Time{"a.txt": time.Unix(1700000000, 0), "sub/b.txt": time.Unix(1600000000, 0)}
+	for name, mtime := range mtimes {
+		stub.Put("/src/"+name, []byte("contents of "+name))
+		stub.Lock()
+		stat := stub.Files["/src/"+name]
+		stat.Mtime = int(mtime.Unix())
+		stub.Files["/src/"+name] = stat
+		stub.Unlock()
+	}
+	return mtimes
+}
+
+func TestArchiveToTar(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	mtimes := archivedTree(stub)
+	var archive bytes.Buffer
+	err := af.ArchiveToWithOptions(context.Background(), "/src/", &archive, ArchiveTar, &ArchiveOptions{Manifest: true, ManifestName: "SUMS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&archive)
+	var names []string
+	var manifest string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		data, _ := io.ReadAll(tr)
+		if header.Name == "SUMS" {
+			manifest = string(data)
+			continue
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if string(data) != "contents of "+header.Name || header.Size != int64(len(data)) {
+			t.Errorf("%s: %d bytes %q", header.Name, header.Size, data)
+		}
+		if !header.ModTime.Equal(mtimes[header.Name]) {
+			t.Errorf("%s: mtime %s, want %s", header.Name, header.ModTime, mtimes[header.Name])
+		}
+	}
+	if strings.Join(names, " ") != "sub/ sub/b.txt a.txt SUMS" {
+		t.Errorf("entries %q", names)
+	}
+	var want strings.Builder
+	for _, name := range []string{"sub/b.txt", "a.txt"} {
+		sum := sha256.Sum256([]byte("contents of " + name))
+		want.WriteString(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	}
+	if manifest != want.String() {
+		t.Errorf("manifest %q, want %q", manifest, want.String())
+	}
+}
+
+func TestArchiveToZip(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	mtimes := archivedTree(stub)
+	var archive bytes.Buffer
+	err := af.ArchiveTo(context.Background(), "/src", &archive, ArchiveZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 3 {
+		t.Errorf("%d entries, want 3", len(zr.File))
+	}
+	for _, file := range zr.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		body, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "contents of "+file.Name {
+			t.Errorf("%s: %q", file.Name, data)
+		}
+		if !file.Modified.Equal(mtimes[file.Name]) {
+			t.Errorf("%s: mtime %s, want %s", file.Name, file.Modified, mtimes[file.Name])
+		}
+	}
+}
+
+func TestArchiveToChecksMismatches(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	stub.Put("/src/a.txt", []byte("alpha"))
+	stub.Lock()
+	stub.Uploads["/src/a.txt"] = []byte("alphX")
+	stub.Unlock()
+	var checksum *ChecksumError
+	err := af.ArchiveTo(context.Background(), "/src", io.Discard, ArchiveTar)
+	if !errors.As(err, &checksum) || checksum.Path != "/src/a.txt" {
+		t.Errorf("changed body: %v", err)
+	}
+
+	stub.Lock()
+	stub.Uploads["/src/a.txt"] = []byte("alpha and more")
+	stub.Unlock()
+	err = af.ArchiveTo(context.Background(), "/src", io.Discard, ArchiveTar)
+	if err == nil {
+		t.Error("archived a body longer than listed")
+	}
+
+	err = af.ArchiveTo(context.Background(), "/src", io.Discard, "rar")
+	if err == nil {
+		t.Error("archived to an unknown format")
+	}
+}
@@ -0,0 +1,110 @@
+package agileapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// atomicPrefix starts the hidden names atomic uploads are written to.
+const atomicPrefix = ".agile-tmp-"
+
+func atomicTempName(filename string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return atomicPrefix + hex.EncodeToString(random) + "-" + filename
+}
+
+// IsAtomicTemp reports whether filename is an atomic upload's temp name.
+func IsAtomicTemp(filename string) bool {
+	return strings.HasPrefix(filename, atomicPrefix)
+}
+
+// uploadAtomic uploads to a temp name next to filename, checks the sha256
+// Agile has against what was sent and only then renames it into place.  The
+// temp is removed if anything fails.
+func (me *AgileFiles) uploadAtomic(dir, filename string, data io.Reader, size int64, progress bool, opts *UploadOptions) (_ string, err error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	err = opts.before(me.AgileApi, dir+filename)
+	if err != nil {
+		return "", err
+	}
+	tmpopts := *opts
+	tmpopts.Atomic = false
+	tmpopts.FailIfExists = false
+	tmpopts.Mtime = time.Time{}
+	tmpname := atomicTempName(filename)
+	defer func() {
+		if err != nil {
+			rmerr := me.AgileApi.RmFile(dir + tmpname)
+			if rmerr != nil {
+				me.logger().Warn("atomic upload temp not removed", "path", dir+tmpname, "error", rmerr)
+			}
+		}
+	}()
+	sha, err := me.UploadFileStreamReturnShaWithOptions(dir, tmpname, data, size, progress, &tmpopts)
+	if err != nil {
+		return "", err
+	}
+	err = me.checkSha(dir+tmpname, sha)
+	var mismatch *ChecksumError
+	if errors.As(err, &mismatch) {
+		mismatch.Path = dir + filename
+	}
+	if err != nil {
+		return "", err
+	}
+	err = me.AgileApi.RenameFile(dir+tmpname, dir+filename)
+	if err != nil {
+		return "", err
+	}
+	// Past the rename there's no temp left to clean up.
+	return sha, opts.after(me.AgileApi, dir+filename)
+}
+
+// SweepAtomicTemps removes atomic upload temps under root that haven't
+// been touched for age, as left behind by processes that died mid upload.
+func (me *AgileFiles) SweepAtomicTemps(root string, age time.Duration) (removed []string, err error) {
+	me, end := me.trace("SweepAtomicTemps", pathAttr(root))
+	defer end(&err)
+	cutoff := time.Now().Add(-age)
+	err = Walk(me, root, func(mypath string, file Filestruct, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir || !IsAtomicTemp(file.Filename) || file.Mtime.After(cutoff) {
+			return nil
+		}
+		err = me.AgileApi.RmFile(mypath)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, mypath)
+		return nil
+	})
+	return removed, err
+}
+
+// putAtomic is Put through a temp name and Rename for any Backend.
+// AgileFiles also checks the sha256 before renaming.
+func putAtomic(b Backend, mypath string, data io.Reader) error {
+	if af, ok := b.(*AgileFiles); ok {
+		return af.PutWithOptions(mypath, data, &UploadOptions{Atomic: true})
+	}
+	dir, filename := path.Split(mypath)
+	tmppath := dir + atomicTempName(filename)
+	err := b.Put(tmppath, data)
+	if err == nil {
+		err = b.Rename(tmppath, mypath)
+	}
+	if err != nil {
+		b.Delete(tmppath)
+	}
+	return err
+}
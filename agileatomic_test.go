@@ -0,0 +1,24 @@
+package agileapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAtomicUpload(t *testing.T) {
+	for _, nochecksums := range []bool{false, true} {
+		stub := newStubAgile(t)
+		stub.Lock()
+		stub.NoChecksums = nochecksums
+		stub.Unlock()
+		af := stub.agileFiles(stub.api())
+		_, err := af.UploadFileStreamReturnShaWithOptions("/dir", "f.txt", strings.NewReader("atomic"), 0, false, &UploadOptions{Atomic: true})
+		if err != nil {
+			t.Errorf("atomic upload with checksums left out of stats %v: %s", nochecksums, err)
+			continue
+		}
+		if paths := stub.Paths(); len(paths) != 1 || paths[0] != "/dir/f.txt" {
+			t.Errorf("atomic upload with checksums left out of stats %v stored %q", nochecksums, paths)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package agileapi
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Backend is the storage interface the helpers in this package are written
+// against.  Paths are slash separated and rooted at "/".  AgileFiles,
+// LocalBackend and MemBackend all implement it.
+type Backend interface {
+	// List returns the directories and files directly under dir.
+	List(dir string) ([]Filestruct, error)
+	Stat(path string) (fs.FileInfo, error)
+	// Put writes data to path, creating any missing parent directories.
+	Put(path string, data io.Reader) error
+	Open(path string) (io.ReadCloser, error)
+	// Delete removes a file or an empty directory.
+	Delete(path string) error
+	Rename(oldpath, newpath string) error
+	Mkdir(path string) error
+	SetMtime(path string, mtime time.Time) error
+}
+
+var (
+	_ Backend = (*AgileFiles)(nil)
+	_ Backend = (*LocalBackend)(nil)
+	_ Backend = (*MemBackend)(nil)
+)
+
+// FileInfo returns me as an fs.FileInfo.  Sys returns the Filestruct.
+func (me Filestruct) FileInfo() fs.FileInfo {
+	return fileInfo{me}
+}
+
+type fileInfo struct {
+	f Filestruct
+}
+
+func (me fileInfo) Name() string       { return me.f.Filename }
+func (me fileInfo) Size() int64        { return int64(me.f.Size) }
+func (me fileInfo) ModTime() time.Time { return me.f.Mtime }
+func (me fileInfo) IsDir() bool        { return me.f.IsDir }
+func (me fileInfo) Sys() interface{}   { return me.f }
+func (me fileInfo) Mode() fs.FileMode {
+	if me.f.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (me *AgileFiles) List(dir string) (_ []Filestruct, err error) {
+	me, end := me.trace("List", pathAttr(dir))
+	defer end(&err)
+	output, err := me.dirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := me.files(dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(output, files...), nil
+}
+
+func (me *AgileFiles) Stat(mypath string) (_ fs.FileInfo, err error) {
+	me, end := me.trace("Stat", pathAttr(mypath))
+	defer end(&err)
+	stat, err := me.AgileApi.StatFile(mypath)
+	if err != nil {
+		return nil, err
+	}
+	err = stat.Err(mypath)
+	if err != nil {
+		return nil, err
+	}
+	info := statFilestruct(mypath, stat)
+	err = me.plainFilestruct(&info)
+	if err != nil {
+		return nil, err
+	}
+	return info.FileInfo(), nil
+}
+
+func (me *AgileFiles) Put(mypath string, data io.Reader) error {
+	return me.PutWithOptions(mypath, data, nil)
+}
+
+func (me *AgileFiles) PutWithOptions(mypath string, data io.Reader, opts *UploadOptions) (err error) {
+	me, end := me.trace("Put", pathAttr(mypath))
+	defer end(&err)
+	dir, filename := path.Split(mypath)
+	if opts.hashed() {
+		_, err = me.UploadFileStreamReturnShaWithOptions(dir, filename, data, 0, false, opts)
+		return err
+	}
+	err = me.AgileApi.UploadFileStreamWithOptions(dir, filename, data, opts)
+	return err
+}
+
+func (me *AgileFiles) Open(mypath string) (_ io.ReadCloser, err error) {
+	me, end := me.trace("Open", pathAttr(mypath))
+	defer end(&err)
+	body, err := me.openEgress(me.egressURL(mypath))
+	if err != nil {
+		return nil, err
+	}
+	return me.decryptBody(body)
+}
+
+func (me *AgileFiles) Delete(mypath string) (err error) {
+	me, end := me.trace("Delete", pathAttr(mypath))
+	defer end(&err)
+	stat, err := me.AgileApi.StatFile(mypath)
+	if err != nil {
+		return err
+	}
+	err = stat.Err(mypath)
+	if err != nil {
+		return err
+	}
+	if stat.Type == 1 {
+		return me.AgileApi.RmDir(mypath)
+	}
+	return me.AgileApi.RmFile(mypath)
+}
+
+func (me *AgileFiles) Rename(oldpath, newpath string) (err error) {
+	me, end := me.trace("Rename", pathAttr(oldpath))
+	defer end(&err)
+	return me.AgileApi.RenameFile(oldpath, newpath)
+}
+
+func (me *AgileFiles) Mkdir(mypath string) (err error) {
+	me, end := me.trace("Mkdir", pathAttr(mypath))
+	defer end(&err)
+	return me.AgileApi.MkDir2(mypath)
+}
+
+func (me *AgileFiles) SetMtime(mypath string, mtime time.Time) (err error) {
+	me, end := me.trace("SetMtime", pathAttr(mypath))
+	defer end(&err)
+	return me.AgileApi.SetMTime(mypath, strconv.FormatInt(mtime.Unix(), 10))
+}
+
+// statFilestruct converts a stat result into a Filestruct.  Type 1 is a dir.
+// Err is nil when the stat found something, an error matching
+// fs.ErrNotExist when Agile has nothing at mypath, and carries the code for
+// any other failure.
+func (me StatResult) Err(mypath string) error {
+	switch me.Code {
+	case 0:
+		return nil
+	case codeNotFound:
+		return &fs.PathError{Op: "stat", Path: mypath, Err: fs.ErrNotExist}
+	}
+	return &fs.PathError{Op: "stat", Path: mypath, Err: fmt.Errorf("Agile code %d", me.Code)}
+}
+
+// listError is the error for a listing Agile answered with code.
+func listError(mypath string, code int) error {
+	if code == codeNotFound {
+		return &fs.PathError{Op: "list", Path: mypath, Err: fs.ErrNotExist}
+	}
+	return &fs.PathError{Op: "list", Path: mypath, Err: fmt.Errorf("Agile code %d", code)}
+}
+
+func statFilestruct(mypath string, stat StatResult) Filestruct {
+	return Filestruct{
+		Filename: path.Base(mypath),
+		Url:      mypath,
+		Mtime:    time.Unix(int64(stat.Mtime), 0),
+		Ctime:    time.Unix(int64(stat.Ctime), 0),
+		Size:     uint64(stat.Size),
+		Sha256:   stat.Checksum,
+		Path:     mypath,
+		IsDir:    stat.Type == 1,
+		MimeType: stat.MimeType,
+	}
+}
@@ -0,0 +1,102 @@
+package agileapi
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// LocalBackend is a Backend rooted at a directory on local disk.
+type LocalBackend struct {
+	Root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+// local maps a slash path onto the filesystem without letting it escape Root.
+func (me *LocalBackend) local(mypath string) string {
+	return filepath.Join(me.Root, filepath.FromSlash(path.Clean("/"+mypath)))
+}
+
+func (me *LocalBackend) List(dir string) ([]Filestruct, error) {
+	entries, err := ioutil.ReadDir(me.local(dir))
+	if err != nil {
+		return nil, err
+	}
+	var output []Filestruct
+	for _, entry := range entries {
+		output = append(output, localFilestruct(path.Join("/", dir, entry.Name()), entry))
+	}
+	return output, nil
+}
+
+func (me *LocalBackend) Stat(mypath string) (fs.FileInfo, error) {
+	fi, err := os.Stat(me.local(mypath))
+	if err != nil {
+		return nil, err
+	}
+	return localFilestruct(path.Clean("/"+mypath), fi).FileInfo(), nil
+}
+
+func (me *LocalBackend) Put(mypath string, data io.Reader) error {
+	local := me.local(mypath)
+	err := os.MkdirAll(filepath.Dir(local), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, data)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (me *LocalBackend) Open(mypath string) (io.ReadCloser, error) {
+	return os.Open(me.local(mypath))
+}
+
+func (me *LocalBackend) Delete(mypath string) error {
+	return os.Remove(me.local(mypath))
+}
+
+func (me *LocalBackend) Rename(oldpath, newpath string) error {
+	local := me.local(newpath)
+	err := os.MkdirAll(filepath.Dir(local), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(me.local(oldpath), local)
+}
+
+func (me *LocalBackend) Mkdir(mypath string) error {
+	return os.MkdirAll(me.local(mypath), 0755)
+}
+
+func (me *LocalBackend) SetMtime(mypath string, mtime time.Time) error {
+	return os.Chtimes(me.local(mypath), mtime, mtime)
+}
+
+func localFilestruct(mypath string, fi os.FileInfo) Filestruct {
+	output := Filestruct{
+		Filename: fi.Name(),
+		Url:      mypath,
+		Mtime:    fi.ModTime(),
+		Path:     mypath,
+		IsDir:    fi.IsDir(),
+	}
+	if !fi.IsDir() {
+		output.Size = uint64(fi.Size())
+	}
+	return output
+}
@@ -0,0 +1,186 @@
+package agileapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemBackend is an in-memory Backend, handy for development and tests.
+type MemBackend struct {
+	entries map[string]*memEntry
+	mu      sync.Mutex
+}
+
+type memEntry struct {
+	data  []byte
+	mtime time.Time
+	ctime time.Time
+	sha   string
+	dir   bool
+}
+
+func NewMemBackend() *MemBackend {
+	now := time.Now()
+	return &MemBackend{
+		entries: map[string]*memEntry{
+			"/": {dir: true, mtime: now, ctime: now},
+		},
+	}
+}
+
+func (me *MemBackend) filestruct(mypath string, entry *memEntry) Filestruct {
+	return Filestruct{
+		Filename: path.Base(mypath),
+		Url:      mypath,
+		Mtime:    entry.mtime,
+		Ctime:    entry.ctime,
+		Size:     uint64(len(entry.data)),
+		Sha256:   entry.sha,
+		Path:     mypath,
+		IsDir:    entry.dir,
+	}
+}
+
+func (me *MemBackend) List(dir string) ([]Filestruct, error) {
+	dir = path.Clean("/" + dir)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[dir]
+	if !ok || !entry.dir {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+	var output []Filestruct
+	for mypath, entry := range me.entries {
+		if mypath != "/" && path.Dir(mypath) == dir {
+			output = append(output, me.filestruct(mypath, entry))
+		}
+	}
+	sort.Slice(output, func(i, j int) bool { return output[i].Filename < output[j].Filename })
+	return output, nil
+}
+
+func (me *MemBackend) Stat(mypath string) (fs.FileInfo, error) {
+	mypath = path.Clean("/" + mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[mypath]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: mypath, Err: fs.ErrNotExist}
+	}
+	return me.filestruct(mypath, entry).FileInfo(), nil
+}
+
+func (me *MemBackend) Put(mypath string, data io.Reader) error {
+	mypath = path.Clean("/" + mypath)
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if entry, ok := me.entries[mypath]; ok && entry.dir {
+		return &fs.PathError{Op: "put", Path: mypath, Err: fmt.Errorf("is a directory")}
+	}
+	me.mkdirAll(path.Dir(mypath))
+	now := time.Now()
+	me.entries[mypath] = &memEntry{data: content, mtime: now, ctime: now, sha: hex.EncodeToString(sum[:])}
+	return nil
+}
+
+func (me *MemBackend) Open(mypath string) (io.ReadCloser, error) {
+	mypath = path.Clean("/" + mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[mypath]
+	if !ok || entry.dir {
+		return nil, &fs.PathError{Op: "open", Path: mypath, Err: fs.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(entry.data)), nil
+}
+
+func (me *MemBackend) Delete(mypath string) error {
+	mypath = path.Clean("/" + mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[mypath]
+	if !ok {
+		return &fs.PathError{Op: "delete", Path: mypath, Err: fs.ErrNotExist}
+	}
+	if entry.dir {
+		for other := range me.entries {
+			if other != "/" && path.Dir(other) == mypath {
+				return &fs.PathError{Op: "delete", Path: mypath, Err: fmt.Errorf("directory not empty")}
+			}
+		}
+	}
+	delete(me.entries, mypath)
+	return nil
+}
+
+func (me *MemBackend) Rename(oldpath, newpath string) error {
+	oldpath = path.Clean("/" + oldpath)
+	newpath = path.Clean("/" + newpath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.entries[oldpath]; !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	moved := map[string]*memEntry{}
+	for mypath, entry := range me.entries {
+		if mypath == oldpath || strings.HasPrefix(mypath, oldpath+"/") {
+			delete(me.entries, mypath)
+			moved[newpath+mypath[len(oldpath):]] = entry
+		}
+	}
+	me.mkdirAll(path.Dir(newpath))
+	for mypath, entry := range moved {
+		me.entries[mypath] = entry
+	}
+	return nil
+}
+
+func (me *MemBackend) Mkdir(mypath string) error {
+	mypath = path.Clean("/" + mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if entry, ok := me.entries[mypath]; ok && !entry.dir {
+		return &fs.PathError{Op: "mkdir", Path: mypath, Err: fs.ErrExist}
+	}
+	me.mkdirAll(mypath)
+	return nil
+}
+
+func (me *MemBackend) SetMtime(mypath string, mtime time.Time) error {
+	mypath = path.Clean("/" + mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[mypath]
+	if !ok {
+		return &fs.PathError{Op: "setmtime", Path: mypath, Err: fs.ErrNotExist}
+	}
+	entry.mtime = mtime
+	return nil
+}
+
+// mkdirAll creates mypath and its parents.  The caller holds the lock.
+func (me *MemBackend) mkdirAll(mypath string) {
+	for {
+		if _, ok := me.entries[mypath]; ok {
+			return
+		}
+		now := time.Now()
+		me.entries[mypath] = &memEntry{dir: true, mtime: now, ctime: now}
+		mypath = path.Dir(mypath)
+	}
+}
@@ -0,0 +1,36 @@
+package agileapi
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/Harnish/agileapi/internal/agilestub"
+)
+
+func TestStatOnlyNotFoundIsErrNotExist(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	af := stub.agileFiles(api)
+	stub.Lock()
+	stub.Files["/broken"] = agilestub.Stat{Code: -5}
+	stub.Unlock()
+
+	_, err := af.Stat("/missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing path: %v", err)
+	}
+	exists, err := af.Exists("/missing")
+	if exists || err != nil {
+		t.Errorf("Exists of a missing path: %v, %v", exists, err)
+	}
+
+	_, err = af.Stat("/broken")
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat with code -5: %v", err)
+	}
+	kind, err := af.Type("/broken")
+	if err == nil || kind != 0 {
+		t.Errorf("Type with code -5: %d, %v", kind, err)
+	}
+}
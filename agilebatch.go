@@ -0,0 +1,233 @@
+package agileapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultBatchSize is how many calls a Batch sends per request unless Size
+// is set.
+const DefaultBatchSize = 500
+
+// codeTokenExpired is the result Agile gives for a stale token.
+const codeTokenExpired = -10001
+
+// codeNotFound is the stat code Agile gives for a path with nothing there.
+const codeNotFound = -1
+
+// Batch queues calls to be sent as JSON-RPC batch requests, saving a round
+// trip, and a noop, per call.
+//
+//	results, err := api.Batch().Stat("/a").Stat("/b").SetMTime("/a", "1700000000").Do(ctx)
+type Batch struct {
+	api   *AgileApi
+	calls []batchCall
+	// Size is the most calls sent in one request.  Defaults to DefaultBatchSize.
+	Size int
+}
+
+type batchCall struct {
+	method string
+	path   string
+	args   []interface{}
+}
+
+// BatchResult is the outcome of one call in a Batch.
+type BatchResult struct {
+	Method string
+	Path   string
+	// Code is the Agile result code.
+	Code int
+	// Stat is filled in for Stat calls.  As with StatFile a missing path is
+	// not an error, check Code.
+	Stat StatResult
+	Err  error
+}
+
+func (me *AgileApi) Batch() *Batch {
+	return &Batch{api: me}
+}
+
+func (me *Batch) add(method, path string, args ...interface{}) *Batch {
+	me.calls = append(me.calls, batchCall{method: method, path: path, args: append([]interface{}{path}, args...)})
+	return me
+}
+
+func (me *Batch) Stat(path string) *Batch {
+	return me.add("stat", path)
+}
+
+func (me *Batch) SetMTime(path, mtime string) *Batch {
+	return me.add("setMTime", path, mtime)
+}
+
+func (me *Batch) RenameFile(originpath, destpath string) *Batch {
+	return me.add("renameFile", originpath, destpath)
+}
+
+func (me *Batch) SetContentType(path, mimetype string) *Batch {
+	return me.add("setContentType", path, mimetype)
+}
+
+func (me *Batch) RmFile(path string) *Batch {
+	return me.add("deleteFile", path)
+}
+
+func (me *Batch) RmDir(path string) *Batch {
+	return me.add("deleteDir", path)
+}
+
+func (me *Batch) MkDir2(path string) *Batch {
+	return me.add("makeDir2", path)
+}
+
+// Len is the number of calls queued.
+func (me *Batch) Len() int {
+	return len(me.calls)
+}
+
+// Do sends the queued calls and returns a result for each, in the order
+// they were added.  Calls rejected for an expired token are retried once
+// after logging in again.  The error is only set when a request could not
+// be made, in which case the unsent calls carry it too.
+func (me *Batch) Do(ctx context.Context) (results []BatchResult, err error) {
+	api, end := me.api.WithContext(ctx).trace("Batch", attribute.Int("agile.calls", len(me.calls)))
+	defer end(&err)
+	results = make([]BatchResult, len(me.calls))
+	for i, call := range me.calls {
+		results[i] = BatchResult{Method: call.method, Path: call.path}
+	}
+	if len(me.calls) == 0 {
+		return results, nil
+	}
+	size := me.Size
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	api.CheckAuth()
+
+	pending := make([]int, len(me.calls))
+	for i := range pending {
+		pending[i] = i
+	}
+	var token string
+	for attempt := 0; attempt < 2 && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			api.metrics().Retry("batch")
+			api.reauth(token)
+		}
+		token = api.token()
+		var expired []int
+		for start := 0; start < len(pending); start += size {
+			chunk := pending[start:min(start+size, len(pending))]
+			err = me.send(api, chunk, results)
+			if err != nil {
+				for _, i := range pending[start:] {
+					results[i].Err = err
+				}
+				return results, err
+			}
+			for _, i := range chunk {
+				if results[i].Code == codeTokenExpired {
+					expired = append(expired, i)
+				}
+			}
+		}
+		pending = expired
+	}
+	return results, nil
+}
+
+type batchRequest struct {
+	Version string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Id      int           `json:"id"`
+}
+
+type batchResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// send makes one batch request for the calls indexed by chunk.  Ids are the
+// call's index so replies can come back in any order.
+func (me *Batch) send(api *AgileApi, chunk []int, results []BatchResult) error {
+	requests := make([]batchRequest, len(chunk))
+	for n, i := range chunk {
+		call := me.calls[i]
+		requests[n] = batchRequest{
+			Version: "2.0",
+			Method:  call.method,
+			Params:  append([]interface{}{api.token()}, call.args...),
+			Id:      i,
+		}
+	}
+	message, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	output, err := api.rpc().post(api.Url, "POST", "batch", "", message)
+	if err != nil {
+		return err
+	}
+	var responses []batchResponse
+	if !bytes.HasPrefix(bytes.TrimSpace(output), []byte("[")) {
+		// A server that can't batch answers with a single error.
+		var single batchResponse
+		if json.Unmarshal(output, &single) == nil && single.Error != nil {
+			return fmt.Errorf("Batch failed: %s", single.Error.Message)
+		}
+		return fmt.Errorf("Batch failed, unexpected response: %s", output)
+	}
+	err = json.Unmarshal(output, &responses)
+	if err != nil {
+		return err
+	}
+	answered := map[int]bool{}
+	for _, response := range responses {
+		if response.Id < 0 || response.Id >= len(results) {
+			continue
+		}
+		answered[response.Id] = true
+		result := &results[response.Id]
+		result.Err = nil
+		if response.Error != nil {
+			result.Err = fmt.Errorf("%s failed on %s: %s", result.Method, result.Path, response.Error.Message)
+			continue
+		}
+		if result.Method == "stat" {
+			err = json.Unmarshal(response.Result, &result.Stat)
+			result.Code = result.Stat.Code
+		} else {
+			err = json.Unmarshal(response.Result, &result.Code)
+			if err == nil && result.Code == codeTokenExpired {
+				err = fmt.Errorf("Token Expired.")
+			} else if err == nil && result.Code != 0 {
+				err = fmt.Errorf("Unknown response: %d", result.Code)
+			}
+		}
+		result.Err = err
+	}
+	for _, i := range chunk {
+		call := me.calls[i]
+		if call.method != "stat" {
+			api.Cache.invalidate(call.path)
+			if call.method == "renameFile" {
+				api.Cache.invalidate(call.args[1].(string))
+			}
+		}
+		if !answered[i] {
+			results[i].Err = fmt.Errorf("%s on %s got no response", results[i].Method, results[i].Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package agileapi
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBatchRetriesAfterExpiryMidBatch(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	// The noop, the first chunk and one call of the second, then expire.
+	stub.Lock()
+	stub.ExpireAfter = 4
+	stub.Unlock()
+
+	batch := api.Batch()
+	batch.Size = 2
+	for i := 0; i < 6; i++ {
+		batch.SetMTime("/a", "1700000000")
+	}
+	results, err := batch.Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != nil || result.Code != 0 {
+			t.Errorf("call %d: code %d, %v", i, result.Code, result.Err)
+		}
+	}
+	if stub.Logins != 2 {
+		t.Errorf("logged in %d times, want 2", stub.Logins)
+	}
+	retried := 0
+	for _, call := range stub.Calls() {
+		if call.Method == "setMTime" && call.Token == "token-2" {
+			retried++
+		}
+	}
+	if retried != 3 {
+		t.Errorf("%d calls retried with the new token, want 3", retried)
+	}
+}
@@ -0,0 +1,244 @@
+package agileapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BulkOp is one operation of a bulk job.  Op is one of delete, rename,
+// setmtime, mkdir or upload.
+type BulkOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Dest is the new path for rename.
+	Dest string `json:"dest,omitempty"`
+	// Mtime is the unix time for setmtime.
+	Mtime int64 `json:"mtime,omitempty"`
+	// Source is the local file for upload.
+	Source string `json:"source,omitempty"`
+}
+
+// BulkResult is written for every operation Bulk runs.  Result logs can be
+// read back with NewBulkReader, which skips the operations that succeeded.
+type BulkResult struct {
+	BulkOp
+	Ok      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+type BulkOptions struct {
+	// Concurrency is how many operations run at once.  Defaults to 4.
+	Concurrency int
+	// RPS limits operations started per second.  0 is unlimited.
+	RPS float64
+	// Results, when set, gets a BulkResult per operation as JSON lines.
+	Results io.Writer
+}
+
+type BulkReport struct {
+	Total     int
+	Succeeded int
+	Failed    int
+}
+
+// BulkSource feeds operations to Bulk.  Next returns io.EOF when done.
+type BulkSource interface {
+	Next() (BulkOp, error)
+}
+
+type bulkList struct {
+	ops []BulkOp
+}
+
+// BulkList is a BulkSource over ops.
+func BulkList(ops []BulkOp) BulkSource {
+	return &bulkList{ops: ops}
+}
+
+func (me *bulkList) Next() (BulkOp, error) {
+	if len(me.ops) == 0 {
+		return BulkOp{}, io.EOF
+	}
+	op := me.ops[0]
+	me.ops = me.ops[1:]
+	return op, nil
+}
+
+// BulkReader reads BulkOps as JSON lines, such as
+//
+//	{"op": "rename", "path": "/old/a.mp4", "dest": "/new/a.mp4"}
+//
+// A result log written by Bulk can be read too, only the failures are
+// returned so the job can be retried.
+type BulkReader struct {
+	dec *json.Decoder
+}
+
+func NewBulkReader(r io.Reader) *BulkReader {
+	return &BulkReader{dec: json.NewDecoder(r)}
+}
+
+func (me *BulkReader) Next() (BulkOp, error) {
+	for {
+		var line struct {
+			BulkOp
+			Ok *bool `json:"ok"`
+		}
+		err := me.dec.Decode(&line)
+		if err != nil {
+			return BulkOp{}, err
+		}
+		if line.Ok != nil && *line.Ok {
+			continue
+		}
+		return line.BulkOp, nil
+	}
+}
+
+// Bulk runs every operation from ops, carrying on past failures.  Each
+// outcome is counted in the report and written to opts.Results, including
+// the operations left unrun when ctx is cancelled.  The error is only set
+// when ops could not be read, a result could not be written or ctx was
+// cancelled.
+func (me *AgileFiles) Bulk(ctx context.Context, ops BulkSource, opts *BulkOptions) (*BulkReport, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = 4
+	}
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.RPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.RPS), 1)
+	}
+	report := &BulkReport{}
+	var enc *json.Encoder
+	if opts.Results != nil {
+		enc = json.NewEncoder(opts.Results)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	af := me.WithContext(ctx)
+	var mu sync.Mutex
+	var failure error
+	fail := func(err error) {
+		mu.Lock()
+		if failure == nil {
+			failure = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	record := func(op BulkOp, err error, seconds float64) {
+		result := BulkResult{BulkOp: op, Ok: err == nil, Seconds: seconds}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		mu.Lock()
+		report.Total++
+		if err == nil {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+		var werr error
+		if enc != nil {
+			werr = enc.Encode(result)
+		}
+		mu.Unlock()
+		if werr != nil {
+			fail(werr)
+		}
+	}
+
+	queue := make(chan BulkOp)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range queue {
+				// Operations cut short by cancellation are still logged as
+				// failures, so a retry picks them up.
+				err := limiter.Wait(ctx)
+				start := time.Now()
+				if err == nil {
+					err = af.bulkOp(op)
+				}
+				record(op, err, time.Since(start).Seconds())
+			}
+		}()
+	}
+
+	readable := true
+	for ctx.Err() == nil {
+		op, err := ops.Next()
+		if err == io.EOF {
+			readable = false
+			break
+		}
+		if err != nil {
+			readable = false
+			fail(err)
+			break
+		}
+		select {
+		case queue <- op:
+		case <-ctx.Done():
+			record(op, ctx.Err(), 0)
+		}
+	}
+	close(queue)
+	wg.Wait()
+	// Log what was never read as failed too, so retrying the failures from
+	// the result log finishes the job.
+	for readable {
+		op, err := ops.Next()
+		if err != nil {
+			break
+		}
+		record(op, ctx.Err(), 0)
+	}
+	if failure == nil && ctx.Err() != nil {
+		failure = ctx.Err()
+	}
+	return report, failure
+}
+
+func (me *AgileFiles) bulkOp(op BulkOp) error {
+	if op.Path == "" {
+		return fmt.Errorf("Bulk %s: no path", op.Op)
+	}
+	switch op.Op {
+	case "delete":
+		return me.Delete(op.Path)
+	case "rename":
+		if op.Dest == "" {
+			return fmt.Errorf("Bulk rename %s: no dest", op.Path)
+		}
+		return me.Rename(op.Path, op.Dest)
+	case "setmtime":
+		return me.SetMtime(op.Path, time.Unix(op.Mtime, 0))
+	case "mkdir":
+		return me.Mkdir(op.Path)
+	case "upload":
+		data, err := os.Open(op.Source)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		return me.Put(op.Path, data)
+	}
+	return fmt.Errorf("Bulk: unknown op %q", op.Op)
+}
@@ -0,0 +1,90 @@
+package agileapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// cancellingSource cancels after handing out n operations.
+type cancellingSource struct {
+	BulkSource
+	n      int
+	cancel context.CancelFunc
+}
+
+func (me *cancellingSource) Next() (BulkOp, error) {
+	if me.n == 0 {
+		me.cancel()
+	}
+	me.n--
+	return me.BulkSource.Next()
+}
+
+func TestBulkLogsEveryOpWhenCancelled(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	var ops []BulkOp
+	for i := 0; i < 10; i++ {
+		ops = append(ops, BulkOp{Op: "mkdir", Path: fmt.Sprintf("/d%d", i)})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &cancellingSource{BulkSource: BulkList(ops), n: 3, cancel: cancel}
+
+	var log bytes.Buffer
+	report, err := af.Bulk(ctx, source, &BulkOptions{Concurrency: 1, Results: &log})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Bulk returned %v, want context.Canceled", err)
+	}
+	if report.Total != len(ops) || report.Succeeded+report.Failed != len(ops) || report.Failed == 0 {
+		t.Errorf("report %+v, want all %d ops with some failed", report, len(ops))
+	}
+
+	// Retrying the failures must cover exactly what didn't succeed.
+	retry := NewBulkReader(&log)
+	seen := map[string]bool{}
+	for {
+		op, err := retry.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[op.Path] = true
+	}
+	if len(seen) != report.Failed {
+		t.Errorf("result log has %d failures, report has %d", len(seen), report.Failed)
+	}
+	for _, op := range ops {
+		stub.Lock()
+		_, made := stub.Files[op.Path]
+		stub.Unlock()
+		if made == seen[op.Path] {
+			t.Errorf("%s made %v, retried %v", op.Path, made, seen[op.Path])
+		}
+	}
+}
+
+func TestBulkCancelledBeforeStart(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ops := []BulkOp{{Op: "mkdir", Path: "/a"}, {Op: "mkdir", Path: "/b"}}
+	var log bytes.Buffer
+	report, _ := af.Bulk(ctx, BulkList(ops), &BulkOptions{Results: &log})
+	if report.Total != 2 || report.Failed != 2 {
+		t.Errorf("report %+v, want 2 failed", report)
+	}
+	retry := NewBulkReader(&log)
+	for range ops {
+		if _, err := retry.Next(); err != nil {
+			t.Fatalf("result log is short: %s", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package agileapi
+
+import (
+	"container/list"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetaCache holds stat results and full listings for a while so repeated
+// IsFile, IsDir, Type, GetFiles and StatFile calls don't go back to Agile.
+// Mutations made through the AgileApi it is set on invalidate the paths
+// they touch; changes made by anyone else show up once entries expire.
+type MetaCache struct {
+	size  int
+	ttl   time.Duration
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	stats CacheStats
+}
+
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	Entries       int
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewMetaCache keeps up to size entries, each for at most ttl.
+func NewMetaCache(size int, ttl time.Duration) *MetaCache {
+	return &MetaCache{
+		size:  size,
+		ttl:   ttl,
+		lru:   list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (me *MetaCache) Stats() CacheStats {
+	if me == nil {
+		return CacheStats{}
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	stats := me.stats
+	stats.Entries = me.lru.Len()
+	return stats
+}
+
+// Purge drops every entry.
+func (me *MetaCache) Purge() {
+	if me == nil {
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.lru.Init()
+	me.items = map[string]*list.Element{}
+}
+
+func (me *MetaCache) get(kind, mypath string) (interface{}, bool) {
+	if me == nil {
+		return nil, false
+	}
+	key := kind + ":" + cachePath(mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	element, ok := me.items[key]
+	if !ok {
+		me.stats.Misses++
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		me.remove(element)
+		me.stats.Misses++
+		return nil, false
+	}
+	me.lru.MoveToFront(element)
+	me.stats.Hits++
+	return entry.value, true
+}
+
+func (me *MetaCache) put(kind, mypath string, value interface{}) {
+	if me == nil || me.size <= 0 {
+		return
+	}
+	key := kind + ":" + cachePath(mypath)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if element, ok := me.items[key]; ok {
+		me.remove(element)
+	}
+	me.items[key] = me.lru.PushFront(&cacheEntry{key: key, value: value, expires: time.Now().Add(me.ttl)})
+	for me.lru.Len() > me.size {
+		me.remove(me.lru.Back())
+		me.stats.Evictions++
+	}
+}
+
+func (me *MetaCache) remove(element *list.Element) {
+	me.lru.Remove(element)
+	delete(me.items, element.Value.(*cacheEntry).key)
+}
+
+// invalidate forgets mypath, everything under it and the stats and
+// listings of its parents, which a change to mypath may have altered.
+// Uploads and makeDir2 create missing parents so all of them go.
+func (me *MetaCache) invalidate(mypath string) {
+	if me == nil {
+		return
+	}
+	mypath = cachePath(mypath)
+	if mypath == "/" {
+		me.Purge()
+		return
+	}
+	affected := map[string]bool{}
+	for parent := mypath; ; parent = path.Dir(parent) {
+		affected[parent] = true
+		if parent == "/" {
+			break
+		}
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for element := me.lru.Front(); element != nil; {
+		next := element.Next()
+		key := element.Value.(*cacheEntry).key
+		cached := key[strings.Index(key, ":")+1:]
+		if affected[cached] || strings.HasPrefix(cached, mypath+"/") {
+			me.remove(element)
+			me.stats.Invalidations++
+		}
+		element = next
+	}
+}
+
+func cachePath(mypath string) string {
+	return path.Clean("/" + mypath)
+}
+
+// CacheStats reports how the metadata cache is doing, if there is one.
+func (me *AgileFiles) CacheStats() CacheStats {
+	return me.AgileApi.Cache.Stats()
+}
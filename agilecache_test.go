@@ -0,0 +1,27 @@
+package agileapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Harnish/agileapi/internal/agilestub"
+)
+
+func TestStatCacheSkipsErrorCodes(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Cache = NewMetaCache(100, time.Minute)
+	stub.Lock()
+	stub.Files["/a"] = agilestub.Stat{Code: -5}
+	stub.Unlock()
+
+	stat, err := api.StatFile("/a")
+	if err != nil || stat.Code != -5 {
+		t.Fatalf("first stat: %+v, %v", stat, err)
+	}
+	stub.Put("/a", []byte("hello"))
+	stat, err = api.StatFile("/a")
+	if err != nil || stat.Code != 0 || stat.Size != 5 {
+		t.Errorf("stat after the error cleared: %+v, %v", stat, err)
+	}
+}
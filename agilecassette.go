@@ -0,0 +1,416 @@
+package agileapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces tokens and passwords written to a cassette.
+const Redacted = "REDACTED"
+
+// CassetteEntry is one line of a cassette file.  Kind is "rpc" for JSON-RPC
+// calls, "upload" for /post/raw uploads and "egress" for GET and HEAD
+// requests to the egress host.
+type CassetteEntry struct {
+	Kind     string            `json:"kind"`
+	Method   string            `json:"method,omitempty"`
+	Args     json.RawMessage   `json:"args,omitempty"`
+	Response json.RawMessage   `json:"response,omitempty"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	// Url, ResponseHeaders and Body are only set on egress entries.  The
+	// body is recorded in full.
+	Url             string            `json:"url,omitempty"`
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+	Body            []byte            `json:"body,omitempty"`
+}
+
+// Cassette is an http.RoundTripper that either records the JSON-RPC calls,
+// uploads and egress reads going through it to a JSONL file, or replays a previously recorded
+// file without touching the network.  Set it as the Transport of the
+// HTTPClient passed in Config.
+type Cassette struct {
+	replay    bool
+	transport http.RoundTripper
+	w         io.Writer
+	entries   []CassetteEntry
+	used      []bool
+	mu        sync.Mutex
+}
+
+// RecordCassette returns a Cassette that passes requests to transport and
+// appends every JSON-RPC call, upload and egress read to w.  A nil transport means
+// http.DefaultTransport.
+func RecordCassette(w io.Writer, transport http.RoundTripper) *Cassette {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Cassette{
+		transport: transport,
+		w:         w,
+	}
+}
+
+// ReplayCassette loads a cassette written by RecordCassette.  Requests are
+// matched by method and args; anything that was not recorded is an error.
+func ReplayCassette(r io.Reader) (*Cassette, error) {
+	me := &Cassette{replay: true}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry CassetteEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Cassette - bad entry %d: %s", len(me.entries)+1, err)
+		}
+		me.entries = append(me.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	me.used = make([]bool, len(me.entries))
+	return me, nil
+}
+
+// Remaining returns the recorded entries that have not been replayed yet.
+func (me *Cassette) Remaining() []CassetteEntry {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	var output []CassetteEntry
+	for i, entry := range me.entries {
+		if !me.used[i] {
+			output = append(output, entry)
+		}
+	}
+	return output
+}
+
+func (me *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/post/raw") {
+		return me.roundTripUpload(req)
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return me.roundTripEgress(req)
+	}
+	return me.roundTripRpc(req)
+}
+
+func (me *Cassette) roundTripRpc(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	call, args, err := decodeCall(body)
+	if err != nil {
+		return nil, fmt.Errorf("Cassette - not a JSON-RPC request: %s %s", req.Method, req.URL)
+	}
+
+	if me.replay {
+		entry, err := me.take(func(e *CassetteEntry) bool {
+			return e.Kind == "rpc" && e.Method == call.Method && bytes.Equal(e.Args, args)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cassette - unexpected call %s %s", call.Method, args)
+		}
+		response := entry.Response
+		if len(call.Id) > 0 {
+			response = withId(response, call.Id)
+		}
+		return cassetteResponse(req, entry.Status, nil, response), nil
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	resp, err := me.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(response))
+	entry := CassetteEntry{
+		Kind:     "rpc",
+		Method:   call.Method,
+		Args:     args,
+		Response: redactResponse(call.Method, response),
+		Status:   resp.StatusCode,
+	}
+	return resp, me.write(entry)
+}
+
+func (me *Cassette) roundTripUpload(req *http.Request) (*http.Response, error) {
+	headers := map[string]string{}
+	for k := range req.Header {
+		if strings.HasPrefix(k, "X-Agile-") {
+			headers[k] = req.Header.Get(k)
+		}
+	}
+	if _, ok := headers["X-Agile-Authorization"]; ok {
+		headers["X-Agile-Authorization"] = Redacted
+	}
+
+	if me.replay {
+		var size int64
+		if req.Body != nil {
+			var err error
+			size, err = io.Copy(ioutil.Discard, req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		entry, err := me.take(func(e *CassetteEntry) bool {
+			return e.Kind == "upload" && e.Size == size && sameHeaders(e.Headers, headers)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cassette - unexpected upload %s%s (%d bytes)", headers["X-Agile-Directory"], headers["X-Agile-Basename"], size)
+		}
+		return cassetteResponse(req, entry.Status, nil, nil), nil
+	}
+
+	counter := &countingReader{}
+	if req.Body != nil {
+		counter.r = req.Body
+		req.Body = ioutil.NopCloser(counter)
+	}
+	resp, err := me.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	entry := CassetteEntry{
+		Kind:    "upload",
+		Status:  resp.StatusCode,
+		Headers: headers,
+		Size:    counter.n,
+	}
+	return resp, me.write(entry)
+}
+
+// roundTripEgress records or replays an egress read, matched by method, url
+// and Range header.
+func (me *Cassette) roundTripEgress(req *http.Request) (*http.Response, error) {
+	headers := map[string]string{}
+	if byterange := req.Header.Get("Range"); byterange != "" {
+		headers["Range"] = byterange
+	}
+	url := req.URL.String()
+
+	if me.replay {
+		entry, err := me.take(func(e *CassetteEntry) bool {
+			return e.Kind == "egress" && e.Method == req.Method && e.Url == url && sameHeaders(e.Headers, headers)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cassette - unexpected egress %s %s", req.Method, url)
+		}
+		header := http.Header{}
+		for k, v := range entry.ResponseHeaders {
+			header.Set(k, v)
+		}
+		resp := cassetteResponse(req, entry.Status, header, nil)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(entry.Body))
+		resp.ContentLength = -1
+		if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = length
+		}
+		return resp, nil
+	}
+
+	resp, err := me.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	entry := CassetteEntry{
+		Kind:            "egress",
+		Method:          req.Method,
+		Status:          resp.StatusCode,
+		Headers:         headers,
+		Url:             url,
+		ResponseHeaders: map[string]string{},
+		Body:            body,
+	}
+	for k := range resp.Header {
+		entry.ResponseHeaders[k] = resp.Header.Get(k)
+	}
+	return resp, me.write(entry)
+}
+
+// take marks the first unused entry matching fn as used.
+func (me *Cassette) take(fn func(*CassetteEntry) bool) (CassetteEntry, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for i := range me.entries {
+		if !me.used[i] && fn(&me.entries[i]) {
+			me.used[i] = true
+			return me.entries[i], nil
+		}
+	}
+	return CassetteEntry{}, fmt.Errorf("no match")
+}
+
+func (me *Cassette) write(entry CassetteEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	_, err = me.w.Write(append(line, '\n'))
+	return err
+}
+
+// rpcCall is the part of a JSON-RPC request a cassette matches on.
+type rpcCall struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Id     json.RawMessage   `json:"id"`
+}
+
+// decodeCall reads a JSON-RPC request and its redacted args.  A batch is
+// recorded as one "batch" call whose args are the method and args of each
+// call in it; its ids are left in the request as they are deterministic.
+func decodeCall(body []byte) (rpcCall, []byte, error) {
+	var call rpcCall
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var calls []rpcCall
+		err := json.Unmarshal(body, &calls)
+		if err != nil {
+			return call, nil, err
+		}
+		batch := make([][]interface{}, len(calls))
+		for i, c := range calls {
+			batch[i] = []interface{}{c.Method, redactArgs(c.Method, c.Params)}
+		}
+		args, err := json.Marshal(batch)
+		return rpcCall{Method: "batch"}, args, err
+	}
+	err := json.Unmarshal(body, &call)
+	if err == nil && call.Method == "" {
+		err = fmt.Errorf("no method")
+	}
+	if err != nil {
+		return call, nil, err
+	}
+	args, err := json.Marshal(redactArgs(call.Method, call.Params))
+	return call, args, err
+}
+
+// redactArgs drops the password from login and the token every other method
+// takes as its first argument.
+func redactArgs(method string, params []json.RawMessage) []json.RawMessage {
+	output := make([]json.RawMessage, len(params))
+	copy(output, params)
+	redacted, _ := json.Marshal(Redacted)
+	if method == "login" {
+		if len(output) > 1 {
+			output[1] = redacted
+		}
+		return output
+	}
+	if len(output) > 0 {
+		output[0] = redacted
+	}
+	return output
+}
+
+// redactResponse drops the token returned by login.
+func redactResponse(method string, response []byte) []byte {
+	if method != "login" {
+		return response
+	}
+	var dec map[string]interface{}
+	if json.Unmarshal(response, &dec) != nil {
+		return response
+	}
+	if result, ok := dec["result"].([]interface{}); ok && len(result) > 0 {
+		result[0] = Redacted
+	}
+	output, err := json.Marshal(dec)
+	if err != nil {
+		return response
+	}
+	return output
+}
+
+func withId(response, id json.RawMessage) json.RawMessage {
+	var dec map[string]json.RawMessage
+	if json.Unmarshal(response, &dec) != nil {
+		return response
+	}
+	dec["id"] = id
+	output, err := json.Marshal(dec)
+	if err != nil {
+		return response
+	}
+	return output
+}
+
+func sameHeaders(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func cassetteResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (me *countingReader) Read(p []byte) (int, error) {
+	n, err := me.r.Read(p)
+	me.n += int64(n)
+	return n, err
+}
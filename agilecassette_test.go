@@ -0,0 +1,115 @@
+package agileapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func cassetteApi(t *testing.T, transport http.RoundTripper) *AgileApi {
+	api, err := NewWithConfig(Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        "https://agile.example.com/jsonrpc",
+		TokenCache: filepath.Join(t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func cassetteSession(api *AgileApi) error {
+	err := api.SetMTime("/a", "1700000000")
+	if err != nil {
+		return err
+	}
+	return api.UploadFileStream("/dir", "b.txt", strings.NewReader("hello"))
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	stub := newStubAgile(t)
+	var recorded bytes.Buffer
+	err := cassetteSession(cassetteApi(t, RecordCassette(&recorded, stub.Transport())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(recorded.String(), "secret") || strings.Contains(recorded.String(), "token-1") {
+		t.Errorf("cassette has the password or token:\n%s", recorded.String())
+	}
+
+	cassette, err := ReplayCassette(bytes.NewReader(recorded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var login, upload bool
+	for _, entry := range cassette.Remaining() {
+		switch entry.Kind + " " + entry.Method {
+		case "rpc login":
+			var args []string
+			json.Unmarshal(entry.Args, &args)
+			login = len(args) > 1 && args[0] == "user" && args[1] == Redacted
+		case "upload ":
+			upload = entry.Headers["X-Agile-Authorization"] == Redacted
+		}
+	}
+	if !login || !upload {
+		t.Errorf("login args redacted %v, upload token redacted %v", login, upload)
+	}
+
+	calls := len(stub.Calls())
+	api := cassetteApi(t, cassette)
+	err = cassetteSession(api)
+	if err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if len(stub.Calls()) != calls {
+		t.Error("replay reached the server")
+	}
+	if remaining := cassette.Remaining(); len(remaining) != 0 {
+		t.Errorf("%d entries not replayed", len(remaining))
+	}
+	if api.SetMTime("/other", "1700000000") == nil {
+		t.Error("a call that wasn't recorded succeeded")
+	}
+}
+
+func TestCassetteEgress(t *testing.T) {
+	stub := newStubAgile(t)
+	stub.Put("/e.txt", []byte("egress body"))
+	open := func(transport http.RoundTripper) ([]byte, error) {
+		af := &AgileFiles{AgileApi: cassetteApi(t, transport), EgressURL: "https://egress.example.com/egress"}
+		r, err := af.Open("/e.txt")
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	var recorded bytes.Buffer
+	data, err := open(RecordCassette(&recorded, stub.Transport()))
+	if err != nil || string(data) != "egress body" {
+		t.Fatalf("recording read %q, %v", data, err)
+	}
+	cassette, err := ReplayCassette(bytes.NewReader(recorded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := len(stub.Calls())
+	data, err = open(cassette)
+	if err != nil || string(data) != "egress body" {
+		t.Fatalf("replay read %q, %v", data, err)
+	}
+	if len(stub.Calls()) != calls {
+		t.Error("replay reached the server")
+	}
+	if remaining := cassette.Remaining(); len(remaining) != 0 {
+		t.Errorf("%d entries not replayed", len(remaining))
+	}
+}
@@ -0,0 +1,128 @@
+package agileapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats for UploadOptions.Compression.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var compressionSuffixes = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+var compressionTypes = map[string]string{
+	CompressionGzip: "application/gzip",
+	CompressionZstd: "application/zstd",
+}
+
+// compressStream compresses data as it's read.
+func compressStream(compression string, data io.Reader) (io.Reader, error) {
+	me := &compressReader{src: data, chunk: make([]byte, 32<<10)}
+	var err error
+	switch compression {
+	case CompressionGzip:
+		me.zw = gzip.NewWriter(&me.buf)
+	case CompressionZstd:
+		me.zw, err = zstd.NewWriter(&me.buf, zstd.WithEncoderConcurrency(1))
+	default:
+		err = fmt.Errorf("agileapi: unknown compression %q", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+// compressReader runs the compressor in step with the reader rather than
+// in a goroutine, so an upload that never starts leaves nothing behind.
+type compressReader struct {
+	src   io.Reader
+	zw    io.WriteCloser
+	buf   bytes.Buffer
+	chunk []byte
+	done  bool
+}
+
+func (me *compressReader) Read(p []byte) (int, error) {
+	for me.buf.Len() == 0 && !me.done {
+		n, err := me.src.Read(me.chunk)
+		if n > 0 {
+			_, werr := me.zw.Write(me.chunk[:n])
+			if werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			me.done = true
+			err = me.zw.Close()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if me.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return me.buf.Read(p)
+}
+
+// compressionOf is how the file at mypath was compressed, from its suffix
+// or content type.
+func compressionOf(mypath, mimetype string) string {
+	for compression, suffix := range compressionSuffixes {
+		if strings.HasSuffix(mypath, suffix) {
+			return compression
+		}
+	}
+	for compression, contenttype := range compressionTypes {
+		if mimetype == contenttype {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+type decompressBody struct {
+	io.Reader
+	close func() error
+}
+
+func (me *decompressBody) Close() error {
+	return me.close()
+}
+
+// decompress undoes the compression of the stored form of the file.
+func (me *File) decompress(body io.ReadCloser) (io.ReadCloser, error) {
+	switch compressionOf(me.Path, me.MimeType) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return &decompressBody{zr, body.Close}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return &decompressBody{zr, func() error {
+			zr.Close()
+			return body.Close()
+		}}, nil
+	}
+	return body, nil
+}
@@ -0,0 +1,86 @@
+package agileapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, r io.Reader, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDecompressIsOptIn(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	af := stub.agileFiles(api)
+	stored := gzipped(t, "hello, world")
+	stub.Put("/logs/a.log.gz", stored)
+
+	file, err := af.GetFile("/logs/a.log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := file.NewReader()
+	if got := readAll(t, reader, err); got != string(stored) {
+		t.Errorf("NewReader without Decompress gave %q", got)
+	}
+
+	af.Decompress = true
+	reader, err = file.NewReader()
+	if got := readAll(t, reader, err); got != "hello, world" {
+		t.Errorf("NewReader with Decompress gave %q", got)
+	}
+	// Ranges are of what is stored at every offset.
+	whole, err := file.NewRangeReader(0, -1)
+	if got := readAll(t, whole, err); got != string(stored) {
+		t.Errorf("NewRangeReader(0, -1) gave %q", got)
+	}
+	tail, err := file.NewRangeReader(2, -1)
+	if got := readAll(t, tail, err); got != string(stored[2:]) {
+		t.Errorf("NewRangeReader(2, -1) gave %q", got)
+	}
+}
+
+func TestUploadCompressionSuffix(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	af := stub.agileFiles(api)
+	af.Decompress = true
+
+	w := af.NewFileWriterWithOptions("/logs/b.log", &UploadOptions{Compression: CompressionZstd, CompressionSuffix: true})
+	io.Copy(w, strings.NewReader(strings.Repeat("line\n", 1000)))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := af.GetFile("/logs/b.log.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Size >= 5000 {
+		t.Errorf("stored %d bytes, not compressed", file.Size)
+	}
+	reader, err := file.NewReader()
+	if got := readAll(t, reader, err); got != strings.Repeat("line\n", 1000) {
+		t.Errorf("read back %d bytes", len(got))
+	}
+}
@@ -0,0 +1,250 @@
+package agileapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentCache keeps file bodies read from egress on local disk, keyed by
+// path and sha256, so repeat reads of an unchanged file never leave the
+// machine.  Bodies are only kept once their sha256 has been checked, and the
+// cache is picked up again from Dir after a restart.
+type ContentCache struct {
+	dir      string
+	maxbytes int64
+	maxage   time.Duration
+	mu       sync.Mutex
+	entries  map[string]*contentEntry
+	total    int64
+}
+
+type contentEntry struct {
+	size  int64
+	atime time.Time
+}
+
+// NewContentCache uses dir, keeping at most maxbytes in it.  A File whose
+// stat is older than maxage is revalidated with a HEAD before its cached
+// body is used.
+func NewContentCache(dir string, maxbytes int64, maxage time.Duration) (*ContentCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	me := &ContentCache{
+		dir:      dir,
+		maxbytes: maxbytes,
+		maxage:   maxage,
+		entries:  map[string]*contentEntry{},
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name.Name(), "tmp-") {
+			os.Remove(filepath.Join(dir, name.Name()))
+			continue
+		}
+		info, err := name.Info()
+		if err != nil || !info.Mode().IsRegular() || len(name.Name()) != sha256.Size*2 {
+			continue
+		}
+		me.entries[name.Name()] = &contentEntry{size: info.Size(), atime: info.ModTime()}
+		me.total += info.Size()
+	}
+	me.mu.Lock()
+	me.evict("")
+	me.mu.Unlock()
+	return me, nil
+}
+
+func contentKey(f *File) string {
+	sum := sha256.Sum256([]byte(f.Path + "\x00" + f.Sha256))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup opens the cached body for f, if there is one.
+func (me *ContentCache) lookup(f *File) (*os.File, bool) {
+	key := contentKey(f)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	entry, ok := me.entries[key]
+	if !ok {
+		return nil, false
+	}
+	body, err := os.Open(filepath.Join(me.dir, key))
+	if err != nil {
+		delete(me.entries, key)
+		me.total -= entry.size
+		return nil, false
+	}
+	// The mtime carries the LRU order across restarts.
+	entry.atime = time.Now()
+	os.Chtimes(body.Name(), entry.atime, entry.atime)
+	return body, true
+}
+
+// open reads f through the cache.
+func (me *ContentCache) open(f *File) (io.ReadCloser, error) {
+	if f.Sha256 == "" {
+		return f.af.openEgress(f.Url)
+	}
+	if time.Since(f.statted) > me.maxage {
+		err := f.revalidate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if body, ok := me.lookup(f); ok {
+		return body, nil
+	}
+	body, err := f.af.openEgress(f.Url)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(me.dir, "tmp-")
+	if err != nil {
+		// A cache that can't be written to shouldn't stop the read.
+		f.af.logger().Warn("content cache write failed", "path", f.Path, "error", err)
+		return body, nil
+	}
+	return &cacheFill{cache: me, key: contentKey(f), sha: f.Sha256, body: body, tmp: tmp, hash: sha256.New()}, nil
+}
+
+// add moves a verified body into place.
+func (me *ContentCache) add(key, tmpname string, size int64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if size > me.maxbytes {
+		os.Remove(tmpname)
+		return
+	}
+	err := os.Rename(tmpname, filepath.Join(me.dir, key))
+	if err != nil {
+		os.Remove(tmpname)
+		return
+	}
+	if old, ok := me.entries[key]; ok {
+		me.total -= old.size
+	}
+	me.entries[key] = &contentEntry{size: size, atime: time.Now()}
+	me.total += size
+	me.evict(key)
+}
+
+// evict removes least recently used bodies, other than keep, until the
+// cache fits.  The caller holds mu.
+func (me *ContentCache) evict(keep string) {
+	if me.total <= me.maxbytes {
+		return
+	}
+	keys := make([]string, 0, len(me.entries))
+	for key := range me.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return me.entries[keys[i]].atime.Before(me.entries[keys[j]].atime)
+	})
+	for _, key := range keys {
+		if me.total <= me.maxbytes {
+			return
+		}
+		if key == keep {
+			continue
+		}
+		os.Remove(filepath.Join(me.dir, key))
+		me.total -= me.entries[key].size
+		delete(me.entries, key)
+	}
+}
+
+// cacheFill passes an egress body through to the reader while writing it
+// to a temp file, which joins the cache if the whole body matched its sha.
+type cacheFill struct {
+	cache *ContentCache
+	key   string
+	sha   string
+	body  io.ReadCloser
+	tmp   *os.File
+	hash  hash.Hash
+	size  int64
+	err   error
+}
+
+func (me *cacheFill) Read(p []byte) (int, error) {
+	n, err := me.body.Read(p)
+	if n > 0 && me.err == nil {
+		me.hash.Write(p[:n])
+		me.size += int64(n)
+		_, me.err = me.tmp.Write(p[:n])
+	}
+	if err == io.EOF && me.tmp != nil {
+		me.finish()
+	}
+	return n, err
+}
+
+func (me *cacheFill) finish() {
+	cerr := me.tmp.Close()
+	name := me.tmp.Name()
+	me.tmp = nil
+	if me.err == nil && cerr == nil && hex.EncodeToString(me.hash.Sum(nil)) == me.sha {
+		me.cache.add(me.key, name, me.size)
+		return
+	}
+	os.Remove(name)
+}
+
+func (me *cacheFill) Close() error {
+	if me.tmp != nil {
+		// Closed before the end, so nothing to keep.
+		me.tmp.Close()
+		os.Remove(me.tmp.Name())
+		me.tmp = nil
+	}
+	return me.body.Close()
+}
+
+// revalidate refreshes Sha256 and Size from a HEAD of the egress url, and
+// the header of encrypted files.
+func (me *File) revalidate() error {
+	req, err := http.NewRequest("HEAD", me.Url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := me.af.egress(req)
+	if err != nil {
+		return fmt.Errorf("Egress request failed %s Error: %s", me.Url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("File Not Found : %s", me.Url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Egress request failed %s Status: %d", me.Url, resp.StatusCode)
+	}
+	if sha := resp.Header.Get("X-Agile-Checksum"); sha != "" {
+		me.Sha256 = sha
+	}
+	if resp.ContentLength >= 0 {
+		me.stored = uint64(resp.ContentLength)
+		size, err := me.PlainSize()
+		if err != nil {
+			return err
+		}
+		me.Size = uint64(size)
+	}
+	me.statted = time.Now()
+	return nil
+}
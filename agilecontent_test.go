@@ -0,0 +1,131 @@
+package agileapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cachedFiles is an AgileFiles on the stub reading through a cache in dir.
+func (me *stubAgile) cachedFiles(dir string, maxbytes int64, maxage time.Duration) *AgileFiles {
+	cache, err := NewContentCache(dir, maxbytes, maxage)
+	if err != nil {
+		me.t.Fatal(err)
+	}
+	af := me.agileFiles(me.api())
+	af.ContentCache = cache
+	return af
+}
+
+// cachedRead returns the contents of mypath, going by a fresh stat.
+func cachedRead(t *testing.T, af *AgileFiles, mypath string) (string, error) {
+	t.Helper()
+	file, err := af.GetFile(mypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := file.Contents()
+	return string(data), err
+}
+
+// forget removes mypath from egress but leaves its stat, so only the cache
+// can serve it.
+func (me *stubAgile) forget(mypath string) {
+	me.Lock()
+	defer me.Unlock()
+	delete(me.Uploads, mypath)
+}
+
+func TestContentCacheServesRepeatReads(t *testing.T) {
+	stub := newStubAgile(t)
+	dir := t.TempDir()
+	af := stub.cachedFiles(dir, 1<<20, time.Hour)
+	stub.Put("/a.txt", []byte("alpha"))
+	if data, err := cachedRead(t, af, "/a.txt"); err != nil || data != "alpha" {
+		t.Fatalf("first read %q, %v", data, err)
+	}
+	stub.forget("/a.txt")
+	if data, err := cachedRead(t, af, "/a.txt"); err != nil || data != "alpha" {
+		t.Errorf("cached read %q, %v", data, err)
+	}
+
+	// A new process finds the cache on disk.
+	af = stub.cachedFiles(dir, 1<<20, time.Hour)
+	if data, err := cachedRead(t, af, "/a.txt"); err != nil || data != "alpha" {
+		t.Errorf("read after a restart %q, %v", data, err)
+	}
+
+	// A changed file has a new sha, so it is read afresh.
+	stub.Put("/a.txt", []byte("changed"))
+	if data, err := cachedRead(t, af, "/a.txt"); err != nil || data != "changed" {
+		t.Errorf("read of a changed file %q, %v", data, err)
+	}
+}
+
+func TestContentCacheRevalidates(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.cachedFiles(t.TempDir(), 1<<20, 0)
+	stub.Put("/a.txt", []byte("alpha"))
+	file, err := af.GetFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := file.Contents(); err != nil || string(data) != "alpha" {
+		t.Fatalf("first read %q, %v", data, err)
+	}
+	stub.Put("/a.txt", []byte("changed"))
+	data, err := file.Contents()
+	if err != nil || string(data) != "changed" || file.Size != uint64(len("changed")) {
+		t.Errorf("read with a stale stat %q, %v, size %d", data, err, file.Size)
+	}
+}
+
+func TestContentCacheChecksBodies(t *testing.T) {
+	stub := newStubAgile(t)
+	dir := t.TempDir()
+	af := stub.cachedFiles(dir, 1<<20, time.Hour)
+	stub.Put("/a.txt", []byte("alpha"))
+	stub.Lock()
+	stub.Uploads["/a.txt"] = []byte("alphX")
+	stub.Unlock()
+	cachedRead(t, af, "/a.txt")
+	stub.forget("/a.txt")
+	if data, err := cachedRead(t, af, "/a.txt"); err == nil {
+		t.Errorf("kept a body that doesn't match its sha: %q", data)
+	}
+	if names, _ := os.ReadDir(dir); len(names) != 0 {
+		t.Errorf("cache has %d files", len(names))
+	}
+}
+
+func TestContentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	stub := newStubAgile(t)
+	dir := t.TempDir()
+	af := stub.cachedFiles(dir, 10, time.Hour)
+	for _, name := range []string{"/a", "/b", "/c"} {
+		stub.Put(name, []byte("12345"))
+	}
+	for _, name := range []string{"/a", "/b", "/a", "/c"} {
+		if _, err := cachedRead(t, af, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"/a", "/b", "/c"} {
+		stub.forget(name)
+	}
+	for name, cached := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		if _, err := cachedRead(t, af, name); (err == nil) != cached {
+			t.Errorf("%s: cached %v, want %v", name, err == nil, cached)
+		}
+	}
+	var size int64
+	names, _ := os.ReadDir(dir)
+	for _, name := range names {
+		info, _ := os.Stat(filepath.Join(dir, name.Name()))
+		size += info.Size()
+	}
+	if size > 10 {
+		t.Errorf("cache holds %d bytes, more than 10", size)
+	}
+}
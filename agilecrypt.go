@@ -0,0 +1,471 @@
+package agileapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Encrypted files start with a header holding everything needed to read
+// them back:
+//
+//	magic "AGLENC" | version | segment size, uint32 | salt | key id length | key id
+//
+// followed by the plaintext in EncryptSegmentSize segments, each sealed with
+// AES-256-GCM under a key derived from the provider's key and the salt.
+// The nonce is the segment number plus a flag marking the last segment, so
+// segments can't be reordered or the file cut short, and the header is the
+// additional data of every segment.  Fixed size segments let a range of the
+// plaintext be read by fetching just the segments that cover it.
+const (
+	encryptMagic      = "AGLENC"
+	encryptVersion    = 1
+	encryptSaltLen    = 16
+	encryptMaxHeader  = len(encryptMagic) + 1 + 4 + encryptSaltLen + 1 + 255
+	encryptTagSize    = 16
+	encryptKeyContext = "agileapi encryption"
+)
+
+// EncryptSegmentSize is how much plaintext each sealed segment holds.
+const EncryptSegmentSize = 64 << 10
+
+var ErrDecrypt = errors.New("agileapi: decryption failed")
+
+var errNotEncrypted = errors.New("agileapi: not encrypted")
+
+// KeyProvider supplies the keys for client side encryption.  Keys are at
+// least 16 bytes.
+type KeyProvider interface {
+	// EncryptionKey is the key new uploads are sealed with, and the id
+	// stored in their header to find it again.
+	EncryptionKey() (id string, key []byte, err error)
+	// DecryptionKey returns the key stored under id.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider over a fixed set of keys.  Uploads use
+// Current, so keys can be rotated while older files stay readable.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (me *StaticKeys) EncryptionKey() (string, []byte, error) {
+	key, err := me.DecryptionKey(me.Current)
+	return me.Current, key, err
+}
+
+func (me *StaticKeys) DecryptionKey(id string) ([]byte, error) {
+	key, ok := me.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("agileapi: no key %q", id)
+	}
+	return key, nil
+}
+
+type encryptHeader struct {
+	segsize int
+	salt    []byte
+	keyid   string
+	raw     []byte
+}
+
+func (me *encryptHeader) aead(keys KeyProvider, key []byte) (cipher.AEAD, error) {
+	var err error
+	if key == nil {
+		key, err = keys.DecryptionKey(me.keyid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("agileapi: key %q is too short", me.keyid)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encryptKeyContext))
+	mac.Write(me.salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newEncryptHeader(keyid string) (*encryptHeader, error) {
+	if len(keyid) > 255 {
+		return nil, fmt.Errorf("agileapi: key id %q is too long", keyid)
+	}
+	me := &encryptHeader{segsize: EncryptSegmentSize, salt: make([]byte, encryptSaltLen), keyid: keyid}
+	_, err := rand.Read(me.salt)
+	if err != nil {
+		return nil, err
+	}
+	var raw bytes.Buffer
+	raw.WriteString(encryptMagic)
+	raw.WriteByte(encryptVersion)
+	binary.Write(&raw, binary.BigEndian, uint32(me.segsize))
+	raw.Write(me.salt)
+	raw.WriteByte(byte(len(keyid)))
+	raw.WriteString(keyid)
+	me.raw = raw.Bytes()
+	return me, nil
+}
+
+// readEncryptHeader parses a header from r, returning errNotEncrypted when
+// r doesn't start with one.
+func readEncryptHeader(r *bufio.Reader) (*encryptHeader, error) {
+	magic, err := r.Peek(len(encryptMagic))
+	if string(magic) != encryptMagic {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, errNotEncrypted
+	}
+	fixed := make([]byte, len(encryptMagic)+1+4+encryptSaltLen+1)
+	_, err = io.ReadFull(r, fixed)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if fixed[len(encryptMagic)] != encryptVersion {
+		return nil, fmt.Errorf("agileapi: unknown encryption version %d", fixed[len(encryptMagic)])
+	}
+	rest := fixed[len(encryptMagic)+1:]
+	me := &encryptHeader{segsize: int(binary.BigEndian.Uint32(rest))}
+	me.salt = rest[4 : 4+encryptSaltLen]
+	keyid := make([]byte, rest[4+encryptSaltLen])
+	_, err = io.ReadFull(r, keyid)
+	if err != nil || me.segsize <= 0 || me.segsize > 16<<20 {
+		return nil, ErrDecrypt
+	}
+	me.keyid = string(keyid)
+	me.raw = append(fixed, keyid...)
+	return me, nil
+}
+
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(counter))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptStream seals data with the provider's current key.
+func encryptStream(keys KeyProvider, data io.Reader) (io.Reader, error) {
+	keyid, key, err := keys.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	header, err := newEncryptHeader(keyid)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.aead(keys, key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:    data,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, header.segsize+1),
+		out:    header.raw,
+	}, nil
+}
+
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	header  *encryptHeader
+	counter uint64
+	// buf takes a segment and one byte more, to tell if it's the last.
+	buf    []byte
+	carry  int
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func (me *encryptReader) Read(p []byte) (int, error) {
+	for len(me.out) == 0 {
+		if me.done {
+			return 0, io.EOF
+		}
+		err := me.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, me.out)
+	me.out = me.out[n:]
+	return n, nil
+}
+
+func (me *encryptReader) fill() error {
+	n, err := io.ReadFull(me.src, me.buf[me.carry:])
+	n += me.carry
+	final := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+	if me.counter > math.MaxUint32 {
+		return fmt.Errorf("agileapi: too large to encrypt")
+	}
+	segment := n
+	if !final {
+		segment = me.header.segsize
+	}
+	me.sealed = me.aead.Seal(me.sealed[:0], segmentNonce(me.counter, final), me.buf[:segment], me.header.raw)
+	me.out = me.sealed
+	if final {
+		me.done = true
+		return nil
+	}
+	me.buf[0] = me.buf[segment]
+	me.carry = 1
+	me.counter++
+	return nil
+}
+
+// decryptReader opens the segments of an encrypted file from counter on,
+// dropping skip bytes from the first and stopping after limit bytes unless
+// limit is negative.
+type decryptReader struct {
+	src     io.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	header  *encryptHeader
+	counter uint64
+	// toEnd is set when src runs to the end of the file, so it has to
+	// finish with the last segment.
+	toEnd bool
+	skip  int
+	limit int64
+	buf   []byte
+	carry int
+	plain []byte
+	out   []byte
+	done  bool
+}
+
+func newDecryptReader(src io.Reader, closer io.Closer, aead cipher.AEAD, header *encryptHeader, counter uint64, skip int, limit int64) *decryptReader {
+	return &decryptReader{
+		src:     src,
+		closer:  closer,
+		aead:    aead,
+		header:  header,
+		counter: counter,
+		toEnd:   limit < 0,
+		skip:    skip,
+		limit:   limit,
+		buf:     make([]byte, header.segsize+encryptTagSize+1),
+	}
+}
+
+func (me *decryptReader) Read(p []byte) (int, error) {
+	if me.limit == 0 {
+		return 0, io.EOF
+	}
+	for len(me.out) == 0 {
+		if me.done {
+			return 0, io.EOF
+		}
+		err := me.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if me.limit >= 0 && int64(len(p)) > me.limit {
+		p = p[:me.limit]
+	}
+	n := copy(p, me.out)
+	me.out = me.out[n:]
+	if me.limit >= 0 {
+		me.limit -= int64(n)
+	}
+	return n, nil
+}
+
+func (me *decryptReader) fill() error {
+	n, err := io.ReadFull(me.src, me.buf[me.carry:])
+	n += me.carry
+	eof := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !eof {
+		return err
+	}
+	if n == 0 && me.counter > 0 {
+		// A range starting past the end.
+		me.done = true
+		return nil
+	}
+	full := len(me.buf) - 1
+	segment := n
+	if !eof {
+		segment = full
+	}
+	open := func(final bool) error {
+		me.plain, err = me.aead.Open(me.plain[:0], segmentNonce(me.counter, final), me.buf[:segment], me.header.raw)
+		return err
+	}
+	if eof {
+		me.done = true
+		err = open(true)
+		// A range that stops short of the end finishes on a whole segment
+		// that isn't the last.
+		if err != nil && !me.toEnd && segment == full {
+			err = open(false)
+		}
+	} else {
+		err = open(false)
+	}
+	if err != nil {
+		return ErrDecrypt
+	}
+	if !eof {
+		me.buf[0] = me.buf[segment]
+		me.carry = 1
+	}
+	me.counter++
+	me.out = me.plain
+	if me.skip > 0 {
+		me.out = me.out[min(me.skip, len(me.out)):]
+		me.skip = 0
+	}
+	return nil
+}
+
+// plainSize is the size of the plaintext of a file stored as stored bytes.
+func (me *encryptHeader) plainSize(stored int64) int64 {
+	body := stored - int64(len(me.raw))
+	sealed := int64(me.segsize + encryptTagSize)
+	segments := (body + sealed - 1) / sealed
+	if body <= 0 || segments == 0 {
+		return 0
+	}
+	return body - segments*encryptTagSize
+}
+
+func (me *decryptReader) Close() error {
+	return me.closer.Close()
+}
+
+type bufferedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// decryptBody decrypts a whole file as it's read.  Files that aren't
+// encrypted are passed through.
+func (me *AgileFiles) decryptBody(body io.ReadCloser) (io.ReadCloser, error) {
+	keys := me.AgileApi.Encryption
+	if keys == nil {
+		return body, nil
+	}
+	buffered := bufio.NewReaderSize(body, encryptMaxHeader)
+	header, err := readEncryptHeader(buffered)
+	if err == errNotEncrypted {
+		return bufferedBody{buffered, body}, nil
+	}
+	if err == nil {
+		var aead cipher.AEAD
+		aead, err = header.aead(keys, nil)
+		if err == nil {
+			return newDecryptReader(buffered, body, aead, header, 0, 0, -1), nil
+		}
+	}
+	body.Close()
+	return nil, err
+}
+
+// decryptRange reads length bytes of plaintext from offset by fetching the
+// segments that hold them.  Files that aren't encrypted are read as is.
+func (me *File) decryptRange(offset, length int64) (io.ReadCloser, error) {
+	header, err := me.encryptHeader()
+	if err == errNotEncrypted {
+		return me.rangeGet(offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.aead(me.af.AgileApi.Encryption, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	segsize := int64(header.segsize)
+	sealed := segsize + encryptTagSize
+	first := offset / segsize
+	start := int64(len(header.raw)) + first*sealed
+	count := int64(-1)
+	if length > 0 {
+		count = ((offset+length-1)/segsize - first + 1) * sealed
+	}
+	body, err := me.rangeGet(start, count)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(body, body, aead, header, uint64(first), int(offset%segsize), length), nil
+}
+
+// encryptHeader fetches the file's header, errNotEncrypted if it has none.
+func (me *File) encryptHeader() (*encryptHeader, error) {
+	head, err := me.rangeGet(0, int64(encryptMaxHeader))
+	if err != nil {
+		return nil, err
+	}
+	defer head.Close()
+	return readEncryptHeader(bufio.NewReader(head))
+}
+
+// PlainSize is the size the file reads back as.  Encrypted files are
+// stored larger than that by their header and a tag per segment, so with
+// Encryption set this costs a request for the header.
+func (me *File) PlainSize() (int64, error) {
+	if me.af.AgileApi.Encryption == nil || me.stored == 0 {
+		return int64(me.stored), nil
+	}
+	header, err := me.encryptHeader()
+	if err == errNotEncrypted {
+		return int64(me.stored), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return header.plainSize(int64(me.stored)), nil
+}
+
+// PlainSize is File.PlainSize for the file at mypath stored as stored
+// bytes, for callers that already have its stat.
+func (me *AgileFiles) PlainSize(mypath string, stored int64) (int64, error) {
+	file := &File{Url: me.egressURL(mypath), Path: mypath, stored: uint64(stored), af: me}
+	return file.PlainSize()
+}
+
+// plainFilestruct makes file describe what reads give when Encryption is
+// set: its plaintext size, and no checksum, as Agile's is of the
+// ciphertext.
+func (me *AgileFiles) plainFilestruct(file *Filestruct) error {
+	if me.AgileApi.Encryption == nil || file.IsDir {
+		return nil
+	}
+	size, err := me.PlainSize(file.Path, int64(file.Size))
+	if err != nil {
+		return err
+	}
+	file.Size = uint64(size)
+	file.Sha256 = ""
+	return nil
+}
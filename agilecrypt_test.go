@@ -0,0 +1,173 @@
+package agileapi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testKeys() *StaticKeys {
+	return &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)}}
+}
+
+func testPlaintext(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func encrypted(t *testing.T, keys KeyProvider, plain []byte) []byte {
+	reader, err := encryptStream(keys, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func decrypted(keys KeyProvider, stored []byte) ([]byte, error) {
+	af := &AgileFiles{AgileApi: &AgileApi{Encryption: keys}}
+	body, err := af.decryptBody(io.NopCloser(bytes.NewReader(stored)))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys := testKeys()
+	segment := EncryptSegmentSize
+	for _, size := range []int{0, 1, segment - 1, segment, segment + 1, 3*segment + 17} {
+		plain := testPlaintext(size)
+		stored := encrypted(t, keys, plain)
+		got, err := decrypted(keys, stored)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: read back %d different bytes", size, len(got))
+		}
+		header, err := readEncryptHeader(bufioReader(stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := header.plainSize(int64(len(stored))); n != int64(size) {
+			t.Errorf("%d bytes: plainSize is %d", size, n)
+		}
+	}
+}
+
+func TestEncryptTruncated(t *testing.T) {
+	keys := testKeys()
+	plain := testPlaintext(2*EncryptSegmentSize + 100)
+	stored := encrypted(t, keys, plain)
+	header, err := readEncryptHeader(bufioReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut on a segment boundary, so what is left opens as whole segments,
+	// and part way through one.
+	boundary := len(header.raw) + 2*(EncryptSegmentSize+encryptTagSize)
+	for _, n := range []int{boundary, len(stored) - 1, len(header.raw) + 10} {
+		_, err = decrypted(keys, stored[:n])
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("cut to %d of %d bytes: %v", n, len(stored), err)
+		}
+	}
+}
+
+func TestEncryptTampered(t *testing.T) {
+	keys := testKeys()
+	plain := testPlaintext(EncryptSegmentSize + 100)
+	stored := encrypted(t, keys, plain)
+	header, err := readEncryptHeader(bufioReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A salt byte, which is in the header, and bytes of each segment.
+	for _, i := range []int{len(encryptMagic) + 6, len(header.raw) + 5, len(stored) - 3} {
+		tampered := append([]byte(nil), stored...)
+		tampered[i] ^= 1
+		_, err = decrypted(keys, tampered)
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("byte %d flipped: %v", i, err)
+		}
+	}
+}
+
+func TestEncryptedFileSizes(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Encryption = testKeys()
+	af := stub.agileFiles(api)
+	plain := testPlaintext(2*EncryptSegmentSize + 100)
+
+	err := af.Put("/secret.bin", bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := af.Stat("/secret.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(plain)) {
+		t.Errorf("Stat size %d, want %d", info.Size(), len(plain))
+	}
+	file, err := af.GetFile("/secret.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := file.PlainSize()
+	if err != nil || size != int64(len(plain)) || file.Size != uint64(len(plain)) {
+		t.Errorf("PlainSize %d, %v, Size %d, want %d", size, err, file.Size, len(plain))
+	}
+	listing, err := af.List("/")
+	if err != nil || len(listing) != 1 || listing[0].Size != uint64(len(plain)) {
+		t.Errorf("List: %+v, %v, want size %d", listing, err, len(plain))
+	}
+	created, err := af.NewFile("new.bin", "/", bytes.NewReader(plain))
+	if err != nil || created.Size != uint64(len(plain)) {
+		t.Errorf("NewFile: %+v, %v, want size %d", created, err, len(plain))
+	}
+	offset := int64(EncryptSegmentSize - 10)
+	body, err := file.NewRangeReader(offset, 30)
+	if got := readAll(t, body, err); got != string(plain[offset:offset+30]) {
+		t.Errorf("range across a segment boundary read %d different bytes", len(got))
+	}
+	contents, err := file.Contents()
+	if err != nil || !bytes.Equal(contents, plain) {
+		t.Errorf("Contents read %d different bytes, %v", len(contents), err)
+	}
+}
+
+func TestSyncEncryptedOnce(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Encryption = testKeys()
+	af := stub.agileFiles(api)
+	err := af.Put("/src/secret.bin", bytes.NewReader(testPlaintext(1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := NewMemBackend()
+	result, err := Sync(af, "/src", dst, "/dst", nil)
+	if err != nil || len(result.Copied) != 1 {
+		t.Fatalf("first Sync: %+v, %v", result, err)
+	}
+	result, err = Sync(af, "/src", dst, "/dst", nil)
+	if err != nil || len(result.Copied) != 0 {
+		t.Errorf("second Sync copied %q, %v", result.Copied, err)
+	}
+}
+
+func bufioReader(data []byte) *bufio.Reader {
+	return bufio.NewReader(bytes.NewReader(data))
+}
@@ -0,0 +1,353 @@
+// Package agiledav serves an Agile account over WebDAV using
+// golang.org/x/net/webdav.
+package agiledav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Harnish/agileapi"
+	"golang.org/x/net/webdav"
+)
+
+// FileSystem is a webdav.FileSystem backed by AgileFiles.  PROPFIND lists
+// through GetPath, GET reads from egress and PUT streams into an atomic
+// upload, so a PUT that fails part way leaves nothing behind.
+type FileSystem struct {
+	Files *agileapi.AgileFiles
+}
+
+var _ webdav.FileSystem = (*FileSystem)(nil)
+
+func New(af *agileapi.AgileFiles) *FileSystem {
+	return &FileSystem{Files: af}
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (me *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = clean(name)
+	if _, err := me.stat(name); err == nil {
+		return os.ErrExist
+	}
+	return me.Files.AgileApi.MkDir2(name)
+}
+
+func (me *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = clean(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return me.create(ctx, name)
+	}
+	info, err := me.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return &dir{fs: me, info: info}, nil
+	}
+	file, err := me.Files.GetFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{info: info, file: file}, nil
+}
+
+func (me *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = clean(name)
+	if name == "/" {
+		return os.ErrPermission
+	}
+	info, err := me.stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return me.Files.AgileApi.RmDir(name)
+	}
+	return me.Files.AgileApi.RmFile(name)
+}
+
+func (me *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return me.Files.AgileApi.RenameFile(clean(oldName), clean(newName))
+}
+
+func (me *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := me.stat(clean(name))
+	if err != nil {
+		return nil, err
+	}
+	return info.FileInfo(), nil
+}
+
+// stat fails with an error matching os.ErrNotExist for missing paths, so
+// the webdav handler answers 404.
+func (me *FileSystem) stat(name string) (agileapi.Filestruct, error) {
+	if name == "/" {
+		return agileapi.Filestruct{Filename: "/", Path: "/", IsDir: true}, nil
+	}
+	info, err := me.Files.Stat(name)
+	if err != nil {
+		return agileapi.Filestruct{}, err
+	}
+	return info.Sys().(agileapi.Filestruct), nil
+}
+
+// contentLengthKey holds a PUT's Content-Length in its context.
+type contentLengthKey struct{}
+
+// WithContentLength records each PUT's Content-Length in its context, so
+// an upload is also aborted when fewer bytes arrive than were announced
+// without the body reporting an error.
+//
+//	handler := agiledav.WithContentLength(&webdav.Handler{FileSystem: agiledav.New(af), ...})
+func WithContentLength(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.ContentLength >= 0 {
+			r = r.WithContext(context.WithValue(r.Context(), contentLengthKey{}, r.ContentLength))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// create starts an atomic upload of name fed by the returned file's Write
+// calls.  It is only renamed into place if the file is closed cleanly.
+func (me *FileSystem) create(ctx context.Context, name string) (webdav.File, error) {
+	dirpath, filename := path.Split(name)
+	if filename == "" {
+		return nil, os.ErrInvalid
+	}
+	pr, pw := io.Pipe()
+	upload := &writeFile{
+		ctx:      ctx,
+		pw:       pw,
+		done:     make(chan error, 1),
+		info:     agileapi.Filestruct{Filename: filename, Path: name, Url: name, Mtime: time.Now()},
+		expected: -1,
+	}
+	if length, ok := ctx.Value(contentLengthKey{}).(int64); ok {
+		upload.expected = length
+	}
+	go func() {
+		_, err := me.Files.UploadFileStreamReturnShaWithOptions(dirpath, filename, pr, 0, false, &agileapi.UploadOptions{Atomic: true})
+		pr.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// readFile is a regular file.  Reads open an egress request at the current
+// offset, so seeking only costs a new request on the next Read.
+type readFile struct {
+	info   agileapi.Filestruct
+	file   *agileapi.File
+	body   io.ReadCloser
+	offset int64
+}
+
+func (me *readFile) Read(p []byte) (int, error) {
+	if me.offset >= int64(me.info.Size) {
+		return 0, io.EOF
+	}
+	if me.body == nil {
+		body, err := me.file.NewRangeReader(me.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		me.body = body
+	}
+	n, err := me.body.Read(p)
+	me.offset += int64(n)
+	return n, err
+}
+
+func (me *readFile) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = me.offset + offset
+	case io.SeekEnd:
+		abs = int64(me.info.Size) + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+	if abs < 0 {
+		return 0, os.ErrInvalid
+	}
+	if abs != me.offset && me.body != nil {
+		me.body.Close()
+		me.body = nil
+	}
+	me.offset = abs
+	return abs, nil
+}
+
+func (me *readFile) Close() error {
+	if me.body != nil {
+		return me.body.Close()
+	}
+	return nil
+}
+
+func (me *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (me *readFile) Stat() (os.FileInfo, error) {
+	return me.info.FileInfo(), nil
+}
+
+func (me *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// writeFile streams everything written to it into an atomic upload.  The
+// upload is aborted on Close if a write or the body failed, the request
+// went away or fewer bytes than expected arrived.
+type writeFile struct {
+	ctx  context.Context
+	pw   *io.PipeWriter
+	done chan error
+	info agileapi.Filestruct
+	// expected is the Content-Length, or -1 when it isn't known.
+	expected int64
+	err      error
+}
+
+func (me *writeFile) Write(p []byte) (int, error) {
+	n, err := me.pw.Write(p)
+	me.info.Size += uint64(n)
+	if err != nil && me.err == nil {
+		me.err = err
+	}
+	return n, err
+}
+
+// ReadFrom is what the webdav handler's io.Copy calls, so a body that fails
+// part way, such as a chunked PUT cut short, aborts the upload on Close.
+// The handler itself closes the file without passing that error on.
+func (me *writeFile) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			written, werr := me.Write(buf[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			if me.err == nil {
+				me.err = err
+			}
+			return total, err
+		}
+	}
+}
+
+func (me *writeFile) Close() error {
+	err := me.err
+	if err == nil {
+		err = me.ctx.Err()
+	}
+	if err == nil && me.expected >= 0 && int64(me.info.Size) != me.expected {
+		err = fmt.Errorf("agiledav: upload of %s got %d of %d bytes", me.info.Path, me.info.Size, me.expected)
+	}
+	if err != nil {
+		me.pw.CloseWithError(err)
+		<-me.done
+		return err
+	}
+	me.pw.Close()
+	return <-me.done
+}
+
+func (me *writeFile) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (me *writeFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return int64(me.info.Size), nil
+	}
+	return 0, fmt.Errorf("agiledav: uploads can not seek")
+}
+
+func (me *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (me *writeFile) Stat() (os.FileInfo, error) {
+	return me.info.FileInfo(), nil
+}
+
+// dir lists its contents through GetPath the first time Readdir is called.
+type dir struct {
+	fs      *FileSystem
+	info    agileapi.Filestruct
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (me *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !me.listed {
+		listing, err := me.fs.Files.List(me.info.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range listing {
+			if !f.IsDir && agileapi.IsAtomicTemp(f.Filename) {
+				continue
+			}
+			me.entries = append(me.entries, f.FileInfo())
+		}
+		me.listed = true
+	}
+	if count <= 0 {
+		output := me.entries
+		me.entries = nil
+		return output, nil
+	}
+	if len(me.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(me.entries) {
+		count = len(me.entries)
+	}
+	output := me.entries[:count]
+	me.entries = me.entries[count:]
+	return output, nil
+}
+
+func (me *dir) Stat() (os.FileInfo, error) {
+	return me.info.FileInfo(), nil
+}
+
+func (me *dir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (me *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (me *dir) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (me *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package agiledav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Harnish/agileapi"
+	"github.com/Harnish/agileapi/internal/agilestub"
+	"golang.org/x/net/webdav"
+)
+
+func stubHandler(t *testing.T) (*webdav.Handler, *agilestub.Server) {
+	stub := agilestub.New(t)
+	api, err := agileapi.NewWithConfig(agileapi.Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        stub.URL + "/jsonrpc",
+		TokenCache: filepath.Join(t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: stub.Transport()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	af := &agileapi.AgileFiles{AgileApi: api, EgressURL: stub.URL + "/egress"}
+	return &webdav.Handler{FileSystem: New(af), LockSystem: webdav.NewMemLS()}, stub
+}
+
+// serveRaw sends a raw HTTP request to handler and waits for the handler
+// to finish with it.
+func serveRaw(t *testing.T, handler http.Handler, request string) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, request)
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler did not finish")
+	}
+}
+
+func TestPut(t *testing.T) {
+	handler, stub := stubHandler(t)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/f", strings.NewReader("hello")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if data, _ := stub.Contents("/f"); string(data) != "hello" {
+		t.Errorf("stored %q", data)
+	}
+	if paths := stub.Paths(); len(paths) != 1 {
+		t.Errorf("stored %q, want only /f", paths)
+	}
+}
+
+func TestPutShortBody(t *testing.T) {
+	handler, stub := stubHandler(t)
+	serveRaw(t, handler, "PUT /f HTTP/1.1\r\nHost: dav\r\nContent-Length: 100\r\n\r\nshort")
+	if paths := stub.Paths(); len(paths) != 0 {
+		t.Errorf("short PUT left %q", paths)
+	}
+}
+
+func TestPutChunkedCutShort(t *testing.T) {
+	handler, stub := stubHandler(t)
+	serveRaw(t, handler, "PUT /f HTTP/1.1\r\nHost: dav\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+	if paths := stub.Paths(); len(paths) != 0 {
+		t.Errorf("cut short chunked PUT left %q", paths)
+	}
+}
+
+type failingReader struct {
+	data string
+}
+
+func (me *failingReader) Read(p []byte) (int, error) {
+	if me.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, me.data)
+	me.data = me.data[n:]
+	return n, nil
+}
+
+// TestPutBodyError covers a body that fails without the request's context
+// being cancelled, which only the file's ReadFrom sees.
+func TestPutBodyError(t *testing.T) {
+	handler, stub := stubHandler(t)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/f", &failingReader{data: "partial"}))
+	if w.Code < 400 {
+		t.Errorf("PUT with a failing body: %d", w.Code)
+	}
+	if paths := stub.Paths(); len(paths) != 0 {
+		t.Errorf("failed PUT left %q", paths)
+	}
+}
+
+func TestReaddirHidesAtomicTemps(t *testing.T) {
+	handler, stub := stubHandler(t)
+	stub.Put("/d/f", []byte("f"))
+	stub.Put("/d/.agile-tmp-1-g", []byte("g"))
+	fs := handler.FileSystem
+	dir, err := fs.OpenFile(context.Background(), "/d", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := dir.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "f" {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		t.Errorf("listed %q, want [f]", names)
+	}
+}
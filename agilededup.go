@@ -0,0 +1,245 @@
+package agileapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// HashCache remembers the sha256 of local files by inode, size and mtime so
+// files that haven't changed aren't hashed again.  Where there are no
+// inodes the file's path stands in.
+type HashCache struct {
+	file    string
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+// NewHashCache loads the cache kept in file, if there is one yet.  An empty
+// file keeps the cache in memory only.
+func NewHashCache(file string) (*HashCache, error) {
+	me := &HashCache{file: file, entries: map[string]string{}}
+	if file == "" {
+		return me, nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return me, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &me.entries)
+	if err != nil {
+		return nil, fmt.Errorf("HashCache - %s Error: %s", file, err)
+	}
+	return me, nil
+}
+
+// Save writes the cache back to its file.
+func (me *HashCache) Save() error {
+	if me == nil || me.file == "" {
+		return nil
+	}
+	me.mu.Lock()
+	data, err := json.Marshal(me.entries)
+	me.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(me.file), filepath.Base(me.file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), me.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func hashKey(localfile string, info os.FileInfo) string {
+	key := fmt.Sprintf("%d:%d:%d", fileInode(info), info.Size(), info.ModTime().UnixNano())
+	if fileInode(info) == 0 {
+		abs, err := filepath.Abs(localfile)
+		if err == nil {
+			localfile = abs
+		}
+		key = localfile + ":" + key
+	}
+	return key
+}
+
+// Sum is the sha256 of localfile, from the cache when it hasn't changed.
+func (me *HashCache) Sum(localfile string) (string, error) {
+	info, err := os.Stat(localfile)
+	if err != nil {
+		return "", err
+	}
+	key := hashKey(localfile, info)
+	if me != nil {
+		me.mu.Lock()
+		sha, ok := me.entries[key]
+		me.mu.Unlock()
+		if ok {
+			return sha, nil
+		}
+	}
+	data, err := os.Open(localfile)
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, data)
+	if err != nil {
+		return "", err
+	}
+	sha := hex.EncodeToString(hash.Sum(nil))
+	if me != nil {
+		me.mu.Lock()
+		me.entries[key] = sha
+		me.mu.Unlock()
+	}
+	return sha, nil
+}
+
+// storedKey is the key the plaintext sha256 of a compressed or encrypted
+// upload is cached under, by the checksum of what Agile stored.
+func storedKey(storedsha string) string {
+	return "stored:" + storedsha
+}
+
+// plain is the sha256 of the plaintext that was uploaded and stored as
+// storedsha, if this cache saw the upload.
+func (me *HashCache) plain(storedsha string) (string, bool) {
+	if me == nil || storedsha == "" {
+		return "", false
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	sha, ok := me.entries[storedKey(storedsha)]
+	return sha, ok
+}
+
+func (me *HashCache) remember(storedsha, sha string) {
+	if me == nil || storedsha == "" {
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.entries[storedKey(storedsha)] = sha
+}
+
+type UploadIfChangedOptions struct {
+	// FixMtime sets the destination's mtime to the local file's, whether it
+	// was uploaded or not.
+	FixMtime bool
+	// Hashes, when set, saves hashing local files that haven't changed.  It
+	// also remembers the plaintext sha256 of compressed and encrypted
+	// uploads, without which those are always uploaded again.
+	Hashes *HashCache
+	// Upload is used when the file has to be sent.
+	Upload *UploadOptions
+}
+
+type UploadIfChangedResult struct {
+	Sha256 string
+	// Skipped is set when Agile already had the content.
+	Skipped bool
+	// Transferred and SkippedBytes are the size of the file, counted on
+	// whichever side it ended up.
+	Transferred  uint64
+	SkippedBytes uint64
+}
+
+// UploadIfChanged uploads localfile to mypath unless mypath already has the
+// same sha256.  When the upload is compressed or encrypted what Agile
+// stores hashes differently every time, so it is only skipped when
+// opts.Hashes recorded the plaintext sha256 of what is there.
+func (me *AgileFiles) UploadIfChanged(mypath, localfile string, opts *UploadIfChangedOptions) (_ *UploadIfChangedResult, err error) {
+	me, end := me.trace("UploadIfChanged", pathAttr(mypath))
+	defer end(&err)
+	if opts == nil {
+		opts = &UploadIfChangedOptions{}
+	}
+	info, err := os.Stat(localfile)
+	if err != nil {
+		return nil, err
+	}
+	sha, err := opts.Hashes.Sum(localfile)
+	if err != nil {
+		return nil, err
+	}
+	result := &UploadIfChangedResult{Sha256: sha}
+	var upload UploadOptions
+	if opts.Upload != nil {
+		upload = *opts.Upload
+	}
+	dir, filename := path.Split(mypath)
+	storedpath := dir + upload.storedName(filename)
+	transformed := upload.Compression != "" || me.AgileApi.Encryption != nil
+
+	stat, err := me.AgileApi.StatFile(storedpath)
+	if err != nil {
+		return nil, err
+	}
+	if err = stat.Err(storedpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var same bool
+	if stat.Code == 0 {
+		remote := stat.Checksum
+		if remote == "" {
+			remote, err = me.remoteSha256(storedpath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if transformed {
+			plain, ok := opts.Hashes.plain(remote)
+			same = ok && plain == sha
+		} else {
+			same = remote == sha
+		}
+	}
+	if same {
+		result.Skipped = true
+		result.SkippedBytes = uint64(info.Size())
+		if opts.FixMtime && int64(stat.Mtime) != info.ModTime().Unix() {
+			err = me.SetMtime(storedpath, info.ModTime())
+		}
+		return result, err
+	}
+	if opts.FixMtime {
+		upload.Mtime = info.ModTime()
+	}
+	data, err := os.Open(localfile)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	storedsha, err := me.UploadFileStreamReturnShaWithOptions(dir, filename, data, info.Size(), false, &upload)
+	if err != nil {
+		return nil, err
+	}
+	if transformed {
+		opts.Hashes.remember(storedsha, sha)
+	}
+	result.Transferred = uint64(info.Size())
+	return result, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package agileapi
+
+import "os"
+
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
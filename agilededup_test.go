@@ -0,0 +1,56 @@
+package agileapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadIfChanged(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		encrypt bool
+		upload  *UploadOptions
+		stored  string
+	}{
+		{"plain", false, nil, "/dir/f.txt"},
+		{"encrypted", true, nil, "/dir/f.txt"},
+		{"compressed", false, &UploadOptions{Compression: CompressionGzip, CompressionSuffix: true}, "/dir/f.txt.gz"},
+	} {
+		stub := newStubAgile(t)
+		api := stub.api()
+		if tc.encrypt {
+			api.Encryption = testKeys()
+		}
+		af := stub.agileFiles(api)
+		local := filepath.Join(t.TempDir(), "f.txt")
+		os.WriteFile(local, []byte("dedup me"), 0644)
+		hashes, _ := NewHashCache("")
+		opts := &UploadIfChangedOptions{Hashes: hashes, Upload: tc.upload}
+
+		result, err := af.UploadIfChanged("/dir/f.txt", local, opts)
+		if err != nil || result.Skipped {
+			t.Fatalf("%s: first upload %+v, %v", tc.name, result, err)
+		}
+		if _, ok := stub.Contents(tc.stored); !ok {
+			t.Errorf("%s: nothing stored at %s, have %q", tc.name, tc.stored, stub.Paths())
+		}
+		result, err = af.UploadIfChanged("/dir/f.txt", local, opts)
+		if err != nil || !result.Skipped {
+			t.Errorf("%s: unchanged upload %+v, %v, want it skipped", tc.name, result, err)
+		}
+
+		os.WriteFile(local, []byte("changed"), 0644)
+		result, err = af.UploadIfChanged("/dir/f.txt", local, opts)
+		if err != nil || result.Skipped {
+			t.Errorf("%s: changed upload %+v, %v, want it sent", tc.name, result, err)
+		}
+
+		// Without a cache a transformed upload can't be compared.
+		opts.Hashes = nil
+		result, err = af.UploadIfChanged("/dir/f.txt", local, opts)
+		if err != nil || result.Skipped != (tc.upload == nil && !tc.encrypt) {
+			t.Errorf("%s: upload without a hash cache %+v, %v", tc.name, result, err)
+		}
+	}
+}
@@ -5,7 +5,12 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type File struct {
@@ -17,49 +22,213 @@ type File struct {
 	Path   string
 	UUID   string
 	Inode  uint64
-	af     *AgileFiles
+	// MimeType is the content type Agile serves the file with.
+	MimeType string
+	af       *AgileFiles
+	// stored is the size Agile has, which is more than Size for encrypted
+	// files.
+	stored uint64
+	// statted is when Sha256 and Size were last fetched.
+	statted time.Time
 }
 
+// NewReader reads the file, decrypted, and decompressed when the
+// AgileFiles has Decompress set.  Reading it to the end gives back its
+// Limits slot, closing it early is up to the caller.
 func (me *File) NewReader() (io.Reader, error) {
-	//FIXME doesn't work
-	// may need to make into a buffio
-	req, err := http.Get(me.Url)
+	return me.open()
+}
+
+// open reads the whole file as NewReader does.
+func (me *File) open() (io.ReadCloser, error) {
+	body, err := me.openStored()
+	if err != nil || !me.af.Decompress {
+		return body, err
+	}
+	return me.decompress(body)
+}
+
+// openStored reads the whole file, through the content cache if there is
+// one, decrypting it when encryption is on.
+func (me *File) openStored() (io.ReadCloser, error) {
+	var body io.ReadCloser
+	var err error
+	if me.af.ContentCache != nil {
+		body, err = me.af.ContentCache.open(me)
+	} else {
+		body, err = me.af.openEgress(me.Url)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("NewReader failed "+me.Url+" Error: ", err)
+		return nil, err
 	}
-	defer req.Body.Close()
-	if req.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("File Not found")
+	return me.af.decryptBody(body)
+}
+
+// NewRangeReader reads length bytes starting at offset from egress.  A
+// negative length reads to the end of the file.  Ranges are never
+// decompressed, whatever the offset.  The caller closes it.
+func (me *File) NewRangeReader(offset, length int64) (io.ReadCloser, error) {
+	if offset == 0 && length < 0 {
+		return me.openStored()
 	}
-	return req.Body, nil
+	if me.af.AgileApi.Encryption != nil {
+		return me.decryptRange(offset, length)
+	}
+	return me.rangeGet(offset, length)
+}
+
+// rangeGet fetches bytes of the file as stored.
+func (me *File) rangeGet(offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", me.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := me.af.egress(req)
+	if err != nil {
+		return nil, fmt.Errorf("Egress request failed %s Error: %s", me.Url, err)
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, egressError(resp, fmt.Errorf("Egress range request failed %s Status: %d", me.Url, resp.StatusCode))
+	}
+	return resp.Body, nil
 }
 
 func (me *File) Contents() ([]byte, error) {
-	req, err := http.Get(me.Url)
+	body, err := me.open()
 	if err != nil {
-		return nil, fmt.Errorf("Contents failed "+me.Url+" Error: ", err)
+		return nil, err
 	}
-	if req.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("File Not Found : " + me.Url)
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// openEgress fetches url from the egress host.  The caller closes the body.
+func (me *AgileFiles) openEgress(url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
-	output, err := ioutil.ReadAll(req.Body)
+	resp, err := me.egress(req)
 	if err != nil {
+		return nil, fmt.Errorf("Egress request failed %s Error: %s", url, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, egressError(resp, fmt.Errorf("File Not Found : %s", url))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, egressError(resp, fmt.Errorf("Egress request failed %s Status: %d", url, resp.StatusCode))
+	}
+	return resp.Body, nil
+}
+
+// egress sends req to the egress host with the configured HTTPClient.  The
+// response body is wrapped so the read is reported to Metrics, and its span
+// ended, when it is closed.
+func (me *AgileFiles) egress(req *http.Request) (*http.Response, error) {
+	api := me.AgileApi
+	req, span := roundTrip(api.context(), api.tracer(), "agile.egress", req, attribute.String("http.url", req.URL.String()))
+	body := &egressBody{
+		metrics: api.metrics(),
+		span:    span,
+		stats:   RequestStats{Kind: "egress", Method: "egress"},
+		start:   time.Now(),
+	}
+	release, err := api.Limits.acquire(api.context())
+	if err != nil {
+		body.err = err
+		body.Close()
+		return nil, err
+	}
+	resp, err := api.client().Do(req)
+	// The slot is only held until the headers arrive.  Holding it while the
+	// body streams would deadlock a copy whose upload needs a slot too.
+	release()
+	if err != nil {
+		body.err = err
+		body.Close()
 		return nil, err
 	}
-	req.Body.Close()
-	return output, nil
+	body.body = api.Limits.downloadReader(api.context(), resp.Body)
+	body.stats.Status = resp.StatusCode
+	resp.Body = body
+	return resp, nil
+}
+
+// egressError closes a response that will not be read, recording err
+// against it.
+func egressError(resp *http.Response, err error) error {
+	if body, ok := resp.Body.(*egressBody); ok {
+		body.err = err
+	}
+	resp.Body.Close()
+	return err
+}
+
+// egressBody reports an egress read once it reaches EOF, fails or is
+// closed, whichever is first.  NewReader hands
+// out bodies callers are not expected to close.
+type egressBody struct {
+	body    io.ReadCloser
+	metrics Metrics
+	span    trace.Span
+	stats   RequestStats
+	start   time.Time
+	err     error
+}
+
+func (me *egressBody) Read(p []byte) (int, error) {
+	n, err := me.body.Read(p)
+	me.stats.BytesIn += int64(n)
+	if err != nil {
+		if err != io.EOF {
+			me.err = err
+		}
+		me.finish()
+	}
+	return n, err
+}
+
+func (me *egressBody) Close() (err error) {
+	if me.body != nil {
+		err = me.body.Close()
+	}
+	me.finish()
+	return err
+}
+
+func (me *egressBody) finish() {
+	if me.metrics != nil {
+		me.stats.Duration = time.Since(me.start)
+		me.stats.Err = me.err
+		me.metrics.Request(me.stats)
+		me.span.SetAttributes(attribute.Int64("agile.size", me.stats.BytesIn), attribute.Int("http.status_code", me.stats.Status))
+		endSpan(me.span, me.err)
+		me.metrics = nil
+	}
 }
 
 func (me *File) Delete() error {
 	err := me.af.AgileApi.RmFile(me.Path)
-	return fmt.Errorf("failed to perform Delete on "+me.Path+" Error: ", err)
+	if err != nil {
+		return fmt.Errorf("failed to perform Delete on %s Error: %s", me.Path, err)
+	}
+	return nil
 }
 
 func (me *File) Rename(newname string) error {
-	fmt.Println("Rename " + me.Path + " to " + newname)
+	me.af.logger().Debug("Rename", "path", me.Path, "newpath", newname)
 	err := me.af.AgileApi.RenameFile(me.Path, newname)
 	if err != nil {
-		return fmt.Errorf("failed to rename "+me.Path+" to "+newname+" Error: ", err)
+		return fmt.Errorf("failed to rename %s to %s Error: %s", me.Path, newname, err)
 	}
 	me.Path = newname
 	return nil
@@ -70,6 +239,10 @@ func (me *File) Move(newname string) error {
 }
 
 func (me *File) SetMtime(mtime time.Time) error {
-	err := me.af.AgileApi.SetMTime(me.Path, string(mtime.Unix()))
-	return fmt.Errorf("Failed to set Mtime on "+me.Path+" Error: ", err)
+	err := me.af.AgileApi.SetMTime(me.Path, strconv.FormatInt(mtime.Unix(), 10))
+	if err != nil {
+		return fmt.Errorf("Failed to set Mtime on %s Error: %s", me.Path, err)
+	}
+	me.Mtime = mtime
+	return nil
 }
@@ -0,0 +1,41 @@
+package agileapi
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNewReaderGivesBackSlotAtEOF(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Limits = NewLimits(0, 0, 0, 1)
+	stub.Put("/a.txt", []byte("hello"))
+
+	file, err := stub.agileFiles(api).GetFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := file.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// The reader is never closed, the next call must still get a slot.
+	done := make(chan error, 1)
+	go func() {
+		done <- api.SetMTime("/a.txt", "1700000000")
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetMTime is still waiting for the slot held by the egress read")
+	}
+}
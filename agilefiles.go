@@ -2,9 +2,10 @@ package agileapi
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"mime"
 	"net/http"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/Harnish/sha256proxy"
+	"go.opentelemetry.io/otel/attribute"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
@@ -25,6 +27,8 @@ type Filestruct struct {
 	Path     string
 	UUID     string
 	Inode    uint64
+	IsDir    bool
+	MimeType string
 }
 
 type FilePath struct {
@@ -38,6 +42,16 @@ type AgileFiles struct {
 	AgileApi  *AgileApi
 	EgressURL string
 	Debug     bool
+	// ContentCache, when set, keeps file bodies read through File on disk.
+	ContentCache *ContentCache
+	// Signer makes the urls returned by File.SignedURL.
+	Signer *URLSigner
+	// Decompress makes File.NewReader and Contents undo UploadOptions
+	// Compression, going by the ".gz" or ".zst" suffix or the
+	// application/gzip or application/zstd content type.  Only set it when
+	// every file named or typed that way was uploaded compressed by this
+	// package, or they are decompressed too.
+	Decompress bool
 }
 
 func ReturnMime(mypath string) (mimename string) {
@@ -49,43 +63,94 @@ func ReturnMime(mypath string) (mimename string) {
 }
 
 func (me *AgileFiles) GetPath(path string) *FilePath {
+	traced, end := me.trace("GetPath", pathAttr(path))
+	defer end(nil)
 	myreturn := &FilePath{
 		Path:  path,
 		af:    me,
-		Dirs:  me.GetDirs(path),
-		Files: me.GetFiles(path),
+		Dirs:  traced.GetDirs(path),
+		Files: traced.GetFiles(path),
 	}
 	return myreturn
 }
 
 func (me *AgileFiles) GetFiles(path string) (files []Filestruct) {
+	files, _ = me.files(path)
+	return
+}
+
+// files is GetFiles returning the error that cut the listing short.
+func (me *AgileFiles) files(path string) (files []Filestruct, err error) {
+	me, end := me.trace("GetFiles", pathAttr(path))
+	defer end(&err)
 	spacer := ""
 	if path != "/" {
 		spacer = "/"
 
 	}
-	me.writedebug(path)
-	myfiles := me.AgileApi.ListAllFilesDetails(path)
+	me.logger().Debug("GetFiles", "path", path)
+	myfiles, err := me.AgileApi.ListFilesDetails(path)
 	for myfile := range myfiles {
-		myurl := path + spacer + myfiles[myfile].Filename
-		mysize := uint64(myfiles[myfile].Stat.Size)
-		mymtime := time.Unix(int64(myfiles[myfile].Stat.Mtime), 0)
-
-		data := Filestruct{
-			Filename: myfiles[myfile].Filename,
-			Url:      myurl,
-			Mtime:    mymtime,
-			Size:     mysize,
-			Sha256:   myfiles[myfile].Stat.Sha256,
-			Path:     myurl,
+		data, ferr := me.fileFromList(path+spacer, myfiles[myfile])
+		if ferr != nil {
+			return files, ferr
 		}
 		files = append(files, data)
 	}
 	return
 }
 
+// ListFilesPage is AgileApi.ListFilesPage returning Filestructs, sized as
+// GetFiles sizes them.
+func (me *AgileFiles) ListFilesPage(path string, pagesize, cookie int) (files []Filestruct, next int, err error) {
+	me, end := me.trace("ListFilesPage", pathAttr(path))
+	defer end(&err)
+	spacer := ""
+	if path != "/" {
+		spacer = "/"
+	}
+	myfiles, next, err := me.AgileApi.ListFilesPage(path, pagesize, cookie)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, myfile := range myfiles {
+		data, err := me.fileFromList(path+spacer, myfile)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, data)
+	}
+	return files, next, nil
+}
+
+// fileFromList is the Filestruct for a file listed in dir.  With Encryption
+// set it is of the plaintext, as with Stat, which costs a request for the
+// header of every file that isn't empty.
+func (me *AgileFiles) fileFromList(dir string, myfile ListFullObject) (Filestruct, error) {
+	myurl := dir + myfile.Filename
+	data := Filestruct{
+		Filename: myfile.Filename,
+		Url:      myurl,
+		Mtime:    time.Unix(int64(myfile.Stat.Mtime), 0),
+		Size:     uint64(myfile.Stat.Size),
+		Sha256:   myfile.Stat.Sha256,
+		Path:     myurl,
+		MimeType: myfile.Stat.MimeType,
+	}
+	err := me.plainFilestruct(&data)
+	return data, err
+}
+
 func (me *AgileFiles) GetDirs(path string) (temp []Filestruct) {
-	mydirs := me.AgileApi.ListAllDirsDetails(path)
+	temp, _ = me.dirs(path)
+	return
+}
+
+// dirs is GetDirs returning the error that cut the listing short.
+func (me *AgileFiles) dirs(path string) (temp []Filestruct, err error) {
+	me, end := me.trace("GetDirs", pathAttr(path))
+	defer end(&err)
+	mydirs, err := me.AgileApi.ListDirsDetails(path)
 	for mydir := range mydirs {
 		spacer := ""
 		if path != "/" {
@@ -100,35 +165,76 @@ func (me *AgileFiles) GetDirs(path string) (temp []Filestruct) {
 			Mtime:    mymtime,
 			Size:     mysize,
 			Path:     myurl,
+			IsDir:    true,
 		}
 		temp = append(temp, data)
 	}
 	return
 }
 
-func (me *AgileFiles) GetFile(path string) (*File, error) {
-	stat, err := me.AgileApi.StatFile(path)
+func (me *AgileFiles) GetFile(path string) (_ *File, err error) {
+	traced, end := me.trace("GetFile", pathAttr(path))
+	defer end(&err)
+	stat, err := traced.AgileApi.StatFile(path)
 	if err != nil {
 		return nil, err
 	}
-	egresspath := me.EgressURL
-	if strings.HasSuffix(me.EgressURL, "/") && strings.HasPrefix(path, "/") {
-		egresspath = strings.TrimSuffix(egresspath, "/")
+	err = stat.Err(path)
+	if err != nil {
+		return nil, err
 	}
+	return me.statFile(path, stat)
+}
+
+// statFile is the File at mypath with stat.  Its Size is the one reads
+// give, which with Encryption set costs a request for the header.
+func (me *AgileFiles) statFile(mypath string, stat StatResult) (*File, error) {
 	returnobj := &File{
-		Url:    egresspath + path,
-		Mtime:  time.Unix(int64(stat.Mtime), 0),
-		Ctime:  time.Unix(int64(stat.Ctime), 0),
-		Size:   uint64(stat.Size),
-		Sha256: stat.Checksum,
-		Path:   path,
-		af:     me,
+		Url:      me.egressURL(mypath),
+		Mtime:    time.Unix(int64(stat.Mtime), 0),
+		Ctime:    time.Unix(int64(stat.Ctime), 0),
+		Sha256:   stat.Checksum,
+		Path:     mypath,
+		MimeType: stat.MimeType,
+		af:       me,
+		stored:   uint64(stat.Size),
+		statted:  time.Now(),
 	}
-
+	size, err := returnobj.PlainSize()
+	if err != nil {
+		return nil, err
+	}
+	returnobj.Size = uint64(size)
 	return returnobj, nil
 }
 
+// egressURL returns the public url for path on the egress host.
+func (me *AgileFiles) egressURL(path string) string {
+	egresspath := me.EgressURL
+	if strings.HasSuffix(me.EgressURL, "/") && strings.HasPrefix(path, "/") {
+		egresspath = strings.TrimSuffix(egresspath, "/")
+	}
+	return egresspath + path
+}
+
 func (me *AgileFiles) UploadFileStreamReturnSha(path, filename string, filereader io.Reader, size int64, progress bool) (string, error) {
+	return me.UploadFileStreamReturnShaWithOptions(path, filename, filereader, size, progress, nil)
+}
+
+func (me *AgileFiles) UploadFileStreamReturnShaWithOptions(path, filename string, filereader io.Reader, size int64, progress bool, opts *UploadOptions) (_ string, err error) {
+	me, end := me.trace("UploadFileStreamReturnSha", pathAttr(path+filename), attribute.Int64("agile.size", size))
+	defer end(&err)
+	filename = opts.storedName(filename)
+	if opts != nil && opts.Verify {
+		return me.uploadVerified(path, filename, filereader, size, progress, opts)
+	}
+	if opts != nil && opts.Atomic {
+		return me.uploadAtomic(path, filename, filereader, size, progress, opts)
+	}
+	filereader, opts, err = me.AgileApi.prepareUpload(filename, filereader, opts)
+	if err != nil {
+		return "", err
+	}
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
@@ -139,14 +245,14 @@ func (me *AgileFiles) UploadFileStreamReturnSha(path, filename string, filereade
 		bar := pb.New64(size).SetUnits(pb.U_BYTES)
 		bar.Start()
 		progress_reader := bar.NewProxyReader(buf_reader)
-		err := me.AgileApi.UploadFileStream(path, filename, progress_reader)
+		err := me.AgileApi.UploadFileStreamWithOptions(path, filename, progress_reader, opts)
 		bar.Finish()
 		if err != nil {
 			return "", fmt.Errorf("AgileFiles.UploadFilesStreamReturnSha - Error: %s", err)
 		}
 
 	} else {
-		err := me.AgileApi.UploadFileStream(path, filename, buf_reader)
+		err := me.AgileApi.UploadFileStreamWithOptions(path, filename, buf_reader, opts)
 		if err != nil {
 			return "", fmt.Errorf("AgileFiles.UploadFilesStreamReturnSha - Error: %s", err)
 		}
@@ -157,14 +263,21 @@ func (me *AgileFiles) UploadFileStreamReturnSha(path, filename string, filereade
 
 }
 
-func (me *AgileFiles) CheckAgileSHA(path, mysha256 string) (bool, error) {
-	me.writedebug("CheckAgileSHA - path: " + path + " SHA256: " + mysha256)
-	response, err := http.Head(me.EgressURL + path)
+func (me *AgileFiles) CheckAgileSHA(path, mysha256 string) (_ bool, err error) {
+	me, end := me.trace("CheckAgileSHA", pathAttr(path))
+	defer end(&err)
+	me.logger().Debug("CheckAgileSHA", "path", path, "sha256", mysha256)
+	req, err := http.NewRequest("HEAD", me.EgressURL+path, nil)
 	if err != nil {
 		return false, err
 	}
+	response, err := me.egress(req)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
 	remoteSha256 := response.Header.Get("X-Agile-Checksum")
-	me.writedebug("CheckAgileSHA - path: " + path + " SHA256: " + mysha256 + " Limelight's sha256: " + remoteSha256)
+	me.logger().Debug("CheckAgileSHA", "path", path, "sha256", mysha256, "remote_sha256", remoteSha256)
 	if remoteSha256 == mysha256 {
 		return true, nil
 	}
@@ -173,79 +286,94 @@ func (me *AgileFiles) CheckAgileSHA(path, mysha256 string) (bool, error) {
 }
 
 func (me *AgileFiles) IsFile(mypath string) (bool, error) {
-	dirpath, filename := path.Split(mypath)
-	var files []Filestruct
-	files = me.GetFiles(dirpath)
-	for _, file := range files {
-		if file.Filename == filename {
-			return true, nil
-		}
-	}
-	return false, nil
+	me, end := me.trace("IsFile", pathAttr(mypath))
+	defer end(nil)
+	kind, err := me.Type(mypath)
+	return kind == 2, err
 }
 
+// Type is the Agile type of mypath from a single stat.
 func (me *AgileFiles) Type(mypath string) (int, error) {
 	// Type 1 is dir
 	// Type 2 is file
 	// Type 0 doesn't exist
-	isfile, err := me.IsFile(mypath)
-	if isfile {
-		return 2, err
+	me, end := me.trace("Type", pathAttr(mypath))
+	defer end(nil)
+	stat, err := me.AgileApi.StatFile(mypath)
+	if err != nil {
+		return 0, err
 	}
-
-	isdir, err := me.IsDir(mypath)
-	if isdir {
-		return 1, err
+	err = stat.Err(mypath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
-	return 0, nil
+	return stat.Type, nil
 }
 
 func (me *AgileFiles) IsDir(mypath string) (bool, error) {
-	dirpath, filename := path.Split(mypath)
-	var files []Filestruct
-	files = me.GetDirs(dirpath)
-	for _, file := range files {
-		if file.Filename == filename {
-			return true, nil
-		}
-	}
-	return false, nil
+	me, end := me.trace("IsDir", pathAttr(mypath))
+	defer end(nil)
+	kind, err := me.Type(mypath)
+	return kind == 1, err
 }
 
-func (me *AgileFiles) writedebug(message string) {
-	if me.Debug {
-		log.Println("DEBUG - agilefiles.go :  " + message)
-	}
+func (me *AgileFiles) Exists(mypath string) (bool, error) {
+	me, end := me.trace("Exists", pathAttr(mypath))
+	defer end(nil)
+	kind, err := me.Type(mypath)
+	return kind != 0, err
+}
+
+// NewFileWriter uploads what is written to mypath.  The upload is finished,
+// and its error returned, by Close.
+func (me *AgileFiles) NewFileWriter(mypath string) io.WriteCloser {
+	return me.NewFileWriterWithOptions(mypath, nil)
+}
 
+func (me *AgileFiles) NewFileWriterWithOptions(mypath string, opts *UploadOptions) io.WriteCloser {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := me.PutWithOptions(mypath, reader, opts)
+		// Fails any further writes if the upload stopped early.
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return &fileWriter{PipeWriter: writer, done: done}
 }
 
-/*
-func (me *AgileFiles) NewFileWriter(filepath string) io.Writer {
-	return me.AgileApi.UploadFileWriter(filepath)
+type fileWriter struct {
+	*io.PipeWriter
+	done chan error
 }
-*/
+
+func (me *fileWriter) Close() error {
+	me.PipeWriter.Close()
+	return <-me.done
+}
+
 func (me *AgileFiles) NewFile(filename, path string, data io.Reader) (*File, error) {
-	err := me.AgileApi.UploadFileStream(path, filename, data)
+	return me.NewFileWithOptions(filename, path, data, nil)
+}
+
+func (me *AgileFiles) NewFileWithOptions(filename, path string, data io.Reader, opts *UploadOptions) (_ *File, err error) {
+	traced, end := me.trace("NewFile", pathAttr(path+filename))
+	defer end(&err)
+	filename = opts.storedName(filename)
+	if opts.hashed() {
+		_, err = traced.UploadFileStreamReturnShaWithOptions(path, filename, data, 0, false, opts)
+	} else {
+		err = traced.AgileApi.UploadFileStreamWithOptions(path, filename, data, opts)
+	}
 	if err != nil {
 		return nil, err
 	}
-	stat, err := me.AgileApi.StatFile(path + filename)
+	stat, err := traced.AgileApi.StatFile(path + filename)
 	if err != nil {
 		return nil, err
 	}
-	egresspath := me.EgressURL
-	if strings.HasSuffix(me.EgressURL, "/") && strings.HasPrefix(path, "/") {
-		egresspath = strings.TrimSuffix(egresspath, "/")
-	}
-	returnobj := &File{
-		Url:    egresspath + path + filename,
-		Mtime:  time.Unix(int64(stat.Mtime), 0),
-		Ctime:  time.Unix(int64(stat.Ctime), 0),
-		Size:   uint64(stat.Size),
-		Sha256: stat.Checksum,
-		Path:   path + filename,
-		af:     me,
-	}
-
-	return returnobj, nil
+	return me.statFile(path+filename, stat)
 }
@@ -0,0 +1,261 @@
+package agileapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileHandler serves an Agile tree over HTTP.  Paths are resolved with
+// StatFile and file bodies are streamed from egress.
+type FileHandler struct {
+	af     *AgileFiles
+	prefix string
+	// Index enables directory listings built from GetPath.  Clients get JSON
+	// when they ask for application/json or pass ?format=json, HTML otherwise.
+	Index bool
+	// CacheControl, when set, is sent with every file response.
+	CacheControl string
+}
+
+// Handler returns an http.Handler serving the Agile tree, with prefix
+// stripped from request paths before they are looked up.
+func (me *AgileFiles) Handler(prefix string) *FileHandler {
+	return &FileHandler{
+		af:     me,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+func (me *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, me.prefix)
+	if rest == r.URL.Path && me.prefix != "" || rest != "" && !strings.HasPrefix(rest, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	mypath := path.Clean("/" + rest)
+	stat, err := me.af.AgileApi.StatFile(mypath)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	err = stat.Err(mypath)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if stat.Type == 1 {
+		if !me.Index {
+			http.NotFound(w, r)
+			return
+		}
+		me.serveIndex(w, r, mypath)
+		return
+	}
+	me.serveFile(w, r, mypath, stat)
+}
+
+func (me *FileHandler) serveFile(w http.ResponseWriter, r *http.Request, mypath string, stat StatResult) {
+	etag := `"` + stat.Checksum + `"`
+	mtime := time.Unix(int64(stat.Mtime), 0).UTC()
+	file, err := me.af.statFile(mypath, stat)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	size := int64(file.Size)
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", mtime.Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if me.CacheControl != "" {
+		h.Set("Cache-Control", me.CacheControl)
+	}
+	if notModified(r, etag, mtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	contenttype := stat.MimeType
+	if contenttype == "" {
+		contenttype = mime.TypeByExtension(path.Ext(mypath))
+	}
+	if contenttype == "" {
+		contenttype = "application/octet-stream"
+	}
+	h.Set("Content-Type", contenttype)
+
+	status := http.StatusOK
+	offset, length := int64(0), size
+	if rng := r.Header.Get("Range"); rng != "" && ifRange(r, etag, mtime) {
+		var ok bool
+		offset, length, ok = ParseRange(rng, size)
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	}
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == "HEAD" || length == 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	body, err := file.NewRangeReader(offset, length)
+	if err != nil {
+		h.Del("Content-Length")
+		h.Del("Content-Range")
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	w.WriteHeader(status)
+	io.Copy(w, body)
+}
+
+// notModified applies If-None-Match, falling back to If-Modified-Since.
+func notModified(r *http.Request, etag string, mtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !mtime.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRange reports whether a Range header should be honoured.
+func ifRange(r *http.Request, etag string, mtime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && mtime.Equal(t)
+}
+
+// ParseRange parses a single byte range header (a-b, a- or -n) against a
+// resource of size bytes.  Multiple ranges are not supported.
+func ParseRange(header string, size int64) (offset, length int64, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+type indexEntry struct {
+	Name   string    `json:"name"`
+	Dir    bool      `json:"dir"`
+	Size   uint64    `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Sha256 string    `json:"sha256,omitempty"`
+}
+
+func (me *FileHandler) serveIndex(w http.ResponseWriter, r *http.Request, mypath string) {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// Cleaned, so a path like //host/dir can't redirect off site.
+		target := path.Clean("/" + r.URL.Path)
+		if target != "/" {
+			target += "/"
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	listing, err := me.af.List(mypath)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	var entries []indexEntry
+	for _, f := range listing {
+		if f.IsDir {
+			entries = append(entries, indexEntry{Name: f.Filename, Dir: true, Mtime: f.Mtime})
+		} else {
+			entries = append(entries, indexEntry{Name: f.Filename, Size: f.Size, Mtime: f.Mtime, Sha256: f.Sha256})
+		}
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if entries == nil {
+			entries = []indexEntry{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": mypath, "entries": entries})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, map[string]interface{}{"Path": mypath, "Entries": entries})
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>Index of {{.Path}}</title></head>
+<body><h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Name}}{{if .Dir}}/{{end}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Mtime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
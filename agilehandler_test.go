@@ -0,0 +1,191 @@
+package agileapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveHandler(handler http.Handler, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandlerServesFiles(t *testing.T) {
+	stub := newStubAgile(t)
+	stub.Put("/site/hello.txt", []byte("hello world"))
+	stub.Lock()
+	stat := stub.Files["/site/hello.txt"]
+	stat.Mtime = 1700000000
+	stub.Files["/site/hello.txt"] = stat
+	stub.Unlock()
+	handler := stub.agileFiles(stub.api()).Handler("/files")
+	handler.CacheControl = "max-age=60"
+	etag := `"` + stat.Checksum + `"`
+	lastmod := time.Unix(1700000000, 0).UTC().Format(http.TimeFormat)
+
+	w := serveHandler(handler, "GET", "/files/site/hello.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Fatalf("GET: %d %q", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{
+		"ETag":           etag,
+		"Last-Modified":  lastmod,
+		"Content-Type":   "text/plain; charset=utf-8",
+		"Content-Length": "11",
+		"Cache-Control":  "max-age=60",
+		"Accept-Ranges":  "bytes",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s is %q, want %q", name, got, want)
+		}
+	}
+
+	w = serveHandler(handler, "HEAD", "/files/site/hello.txt", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "11" {
+		t.Errorf("HEAD: %d %q %q", w.Code, w.Body, w.Header().Get("Content-Length"))
+	}
+
+	for _, tc := range []struct {
+		header map[string]string
+		code   int
+		body   string
+	}{
+		{map[string]string{"Range": "bytes=6-"}, http.StatusPartialContent, "world"},
+		{map[string]string{"Range": "bytes=0-4"}, http.StatusPartialContent, "hello"},
+		{map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "rld"},
+		{map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{map[string]string{"Range": "bytes=0-4", "If-Range": etag}, http.StatusPartialContent, "hello"},
+		{map[string]string{"Range": "bytes=0-4", "If-Range": `"stale"`}, http.StatusOK, "hello world"},
+		{map[string]string{"Range": "bytes=0-4", "If-Range": lastmod}, http.StatusPartialContent, "hello"},
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified, ""},
+		{map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified, ""},
+		{map[string]string{"If-None-Match": `"other"`}, http.StatusOK, "hello world"},
+		{map[string]string{"If-Modified-Since": lastmod}, http.StatusNotModified, ""},
+		{map[string]string{"If-Modified-Since": time.Unix(1600000000, 0).UTC().Format(http.TimeFormat)}, http.StatusOK, "hello world"},
+		// If-None-Match wins over If-Modified-Since.
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastmod}, http.StatusOK, "hello world"},
+	} {
+		w = serveHandler(handler, "GET", "/files/site/hello.txt", tc.header)
+		if w.Code != tc.code || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("GET with %v: %d %q, want %d %q", tc.header, w.Code, w.Body, tc.code, tc.body)
+		}
+	}
+	w = serveHandler(handler, "GET", "/files/site/hello.txt", map[string]string{"Range": "bytes=6-"})
+	if got := w.Header().Get("Content-Range"); got != "bytes 6-10/11" {
+		t.Errorf("Content-Range is %q", got)
+	}
+}
+
+func TestHandlerNotFound(t *testing.T) {
+	stub := newStubAgile(t)
+	stub.Put("/site/hello.txt", []byte("hello"))
+	handler := stub.agileFiles(stub.api()).Handler("/files/")
+	for _, target := range []string{"/files/site/missing", "/other/site/hello.txt", "/filessite/hello.txt", "/files/site"} {
+		if w := serveHandler(handler, "GET", target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d", target, w.Code)
+		}
+	}
+	if w := serveHandler(handler, "PUT", "/files/site/hello.txt", nil); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("PUT: %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestHandlerIndex(t *testing.T) {
+	stub := newStubAgile(t)
+	stub.Put("/site/hello.txt", []byte("hello"))
+	stub.Put("/site/<b>.txt", []byte("b"))
+	stub.Put("/site/sub/x", []byte("x"))
+	handler := stub.agileFiles(stub.api()).Handler("")
+	handler.Index = true
+
+	w := serveHandler(handler, "GET", "/site/?format=json", nil)
+	var index struct {
+		Path    string
+		Entries []indexEntry
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("JSON index: %s %q", err, w.Body)
+	}
+	if index.Path != "/site" || len(index.Entries) != 3 || !index.Entries[0].Dir || index.Entries[0].Name != "sub" {
+		t.Errorf("JSON index %+v", index)
+	}
+	for _, entry := range index.Entries[1:] {
+		if entry.Dir || entry.Size == 0 || entry.Sha256 == "" {
+			t.Errorf("JSON entry %+v", entry)
+		}
+	}
+	w = serveHandler(handler, "GET", "/site/", map[string]string{"Accept": "application/json"})
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Accept: application/json got %q", w.Header().Get("Content-Type"))
+	}
+
+	w = serveHandler(handler, "GET", "/site/", nil)
+	body := w.Body.String()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(body, `<a href="sub/">sub/</a>`) || !strings.Contains(body, `<a href="../">`) {
+		t.Errorf("HTML index %q", body)
+	}
+	if strings.Contains(body, "<b>") || !strings.Contains(body, "&lt;b&gt;.txt") {
+		t.Errorf("HTML index doesn't escape names: %q", body)
+	}
+
+	handler.Index = false
+	if w = serveHandler(handler, "GET", "/site/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("index without Index: %d", w.Code)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		header         string
+		offset, length int64
+		ok             bool
+	}{
+		{"bytes=0-9", 0, 10, true},
+		{"bytes=5-", 5, 95, true},
+		{"bytes=-10", 90, 10, true},
+		{"bytes=-200", 0, 100, true},
+		{"bytes=90-200", 90, 10, true},
+		{"bytes=100-", 0, 0, false},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=0-1,3-4", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+		{"bytes=x-1", 0, 0, false},
+	} {
+		offset, length, ok := ParseRange(tc.header, 100)
+		if offset != tc.offset || length != tc.length || ok != tc.ok {
+			t.Errorf("ParseRange(%q) = %d, %d, %v", tc.header, offset, length, ok)
+		}
+	}
+}
+
+func TestIndexRedirectStaysOnSite(t *testing.T) {
+	stub := newStubAgile(t)
+	stub.Put("/evil.com/x", []byte("x"))
+	stub.Put("/dir/x", []byte("x"))
+	handler := stub.agileFiles(stub.api()).Handler("")
+	handler.Index = true
+	for target, want := range map[string]string{
+		"/dir":             "/dir/",
+		"//evil.com":       "/evil.com/",
+		"///evil.com":      "/evil.com/",
+		"/dir/../evil.com": "/evil.com/",
+	} {
+		r := httptest.NewRequest("GET", "http://files.example.com/", nil)
+		r.URL.Path = target
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("GET %s: %d to %q, want a redirect to %q", target, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
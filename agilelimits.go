@@ -0,0 +1,121 @@
+package agileapi
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// minByteBurst keeps byte limiters from handing out tiny reads when the
+// rate is low.
+const minByteBurst = 32 * 1024
+
+// Limits caps the load a client puts on Agile.  Set it on a Config and it is
+// shared by every AgileApi and AgileFiles made from that Config, including
+// WithContext copies, so goroutines and helpers can't exceed it between
+// them.  Set the same Limits on several Configs to share one budget.
+type Limits struct {
+	rpc      *rate.Limiter
+	upload   *rate.Limiter
+	download *rate.Limiter
+	inflight chan struct{}
+}
+
+// NewLimits makes token bucket limiters for JSON-RPC calls per second and
+// upload and download bytes per second, and caps requests in flight.  Zero
+// leaves that one unlimited.  An upload holds its in flight slot until it
+// has been sent, a download only until its response headers arrive.
+func NewLimits(rps float64, uploadbps, downloadbps int64, maxinflight int) *Limits {
+	me := &Limits{}
+	if rps > 0 {
+		burst := int(rps)
+		if burst < 1 {
+			burst = 1
+		}
+		me.rpc = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+	me.upload = byteLimiter(uploadbps)
+	me.download = byteLimiter(downloadbps)
+	if maxinflight > 0 {
+		me.inflight = make(chan struct{}, maxinflight)
+	}
+	return me
+}
+
+func byteLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	burst := bps
+	if burst < minByteBurst {
+		burst = minByteBurst
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(burst))
+}
+
+// call waits for a JSON-RPC slot.  The caller must call release when the
+// response has been read.
+func (me *Limits) call(ctx context.Context) (release func(), err error) {
+	if me == nil {
+		return func() {}, nil
+	}
+	if me.rpc != nil {
+		err = me.rpc.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return me.acquire(ctx)
+}
+
+// acquire takes one of the in flight slots.
+func (me *Limits) acquire(ctx context.Context) (release func(), err error) {
+	if me == nil || me.inflight == nil {
+		return func() {}, nil
+	}
+	select {
+	case me.inflight <- struct{}{}:
+		return func() { <-me.inflight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (me *Limits) uploadReader(ctx context.Context, r io.Reader) io.Reader {
+	if me == nil || me.upload == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: me.upload}
+}
+
+func (me *Limits) downloadReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if me == nil || me.download == nil {
+		return r
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&limitedReader{ctx: ctx, r: r, limiter: me.download}, r}
+}
+
+// limitedReader waits on a byte limiter for everything it reads.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (me *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > me.limiter.Burst() {
+		p = p[:me.limiter.Burst()]
+	}
+	n, err := me.r.Read(p)
+	if n > 0 {
+		werr := me.limiter.WaitN(me.ctx, n)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,40 @@
+package agileapi
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestCopyWithOneInflightSlot streams a download into an upload, as Sync
+// and the S3 gateway's copy do, with room for one request at a time.
+func TestCopyWithOneInflightSlot(t *testing.T) {
+	stub := newStubAgile(t)
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	stub.Put("/src", data)
+	api := stub.api()
+	api.Limits = NewLimits(0, 0, 0, 1)
+	af := stub.agileFiles(api)
+
+	done := make(chan error, 1)
+	go func() {
+		r, err := af.Open("/src")
+		if err != nil {
+			done <- err
+			return
+		}
+		defer r.Close()
+		done <- af.Put("/dst", r)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("copy deadlocked on the in flight limit")
+	}
+	if copied, _ := stub.Contents("/dst"); !bytes.Equal(copied, data) {
+		t.Errorf("copied %d bytes, want %d", len(copied), len(data))
+	}
+}
@@ -0,0 +1,72 @@
+package agileapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+)
+
+var debugLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+// defaultLogger is used when no Logger is configured.  Debug output goes to
+// stderr only when debug is set, everything else to slog.Default().
+func defaultLogger(debug bool) *slog.Logger {
+	if debug {
+		return debugLogger
+	}
+	return slog.Default()
+}
+
+func (me *AgileApi) logger() *slog.Logger {
+	if me.Logger != nil {
+		return me.Logger
+	}
+	return defaultLogger(me.Debug)
+}
+
+// LogValue keeps the token and password out of logs when an AgileApi is
+// logged as an attribute.
+func (me *AgileApi) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("url", me.Url),
+		slog.String("username", me.Username),
+		slog.String("token", Redacted),
+	)
+}
+
+func (me *AgileFiles) logger() *slog.Logger {
+	return me.AgileApi.logger()
+}
+
+// rpcPath is the path a call acts on, which follows the token.  Args are
+// never logged as they carry the token, or the password for login; only
+// the path is.
+func rpcPath(method string, args []interface{}) (string, bool) {
+	if method == "login" || method == "noop" || len(args) < 2 {
+		return "", false
+	}
+	path, ok := args[1].(string)
+	return path, ok
+}
+
+// resultCode pulls the Agile result code out of a JSON-RPC response.  Some
+// methods return the code as the result, others as result.code.
+func resultCode(response []byte) (int, bool) {
+	var dec struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(response, &dec) != nil || len(dec.Result) == 0 {
+		return 0, false
+	}
+	var code int
+	if json.Unmarshal(dec.Result, &code) == nil {
+		return code, true
+	}
+	var object struct {
+		Code *int `json:"code"`
+	}
+	if json.Unmarshal(dec.Result, &object) == nil && object.Code != nil {
+		return *object.Code, true
+	}
+	return 0, false
+}
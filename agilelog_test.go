@@ -0,0 +1,109 @@
+package agileapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loggedApi is an AgileApi on the stub logging JSON at debug level to log.
+func (me *stubAgile) loggedApi(log io.Writer) *AgileApi {
+	api, err := NewWithConfig(Config{
+		Username:   "user",
+		Password:   "hunter2",
+		Url:        me.URL + "/jsonrpc",
+		TokenCache: filepath.Join(me.t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: me.Transport()},
+		Logger:     slog.New(slog.NewJSONHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	if err != nil {
+		me.t.Fatal(err)
+	}
+	return api
+}
+
+func logRecords(t *testing.T, log *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(log.Bytes()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad log line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogsCallsWithoutSecrets(t *testing.T) {
+	stub := newStubAgile(t)
+	var log bytes.Buffer
+	api := stub.loggedApi(&log)
+	stub.Put("/dir/a.txt", []byte("a"))
+	api.StatFile("/dir/a.txt")
+	api.ListFilesDetails("/dir")
+	api.UploadFileStream("/dir/", "b.txt", strings.NewReader("b"))
+	stub.Lock()
+	stub.ListCodes["/dir"] = -5
+	stub.Unlock()
+	api.ListFilesDetails("/dir")
+	api.Logger.Info("configured", "api", api)
+
+	if strings.Contains(log.String(), "hunter2") || strings.Contains(log.String(), "token-1") {
+		t.Errorf("log has a secret:\n%s", log.String())
+	}
+	var stat, upload, failed, configured bool
+	for _, record := range logRecords(t, &log) {
+		switch {
+		case record["msg"] == "jsonrpc call" && record["method"] == "stat":
+			stat = record["path"] == "/dir/a.txt" && record["code"] == 0.0 && record["status"] == 200.0 && record["duration"] != nil
+		case record["msg"] == "upload":
+			upload = record["path"] == "/dir/b.txt" && record["status"] == 200.0
+		case record["msg"] == "listing failed":
+			failed = record["level"] == "ERROR" && record["path"] == "/dir"
+		case record["msg"] == "configured":
+			group, _ := record["api"].(map[string]interface{})
+			configured = group["token"] == Redacted && group["username"] == "user"
+		}
+	}
+	if !stat || !upload || !failed || !configured {
+		t.Errorf("stat %v, upload %v, failed listing %v, configured %v in:\n%s", stat, upload, failed, configured, log.String())
+	}
+}
+
+func TestNothingOnStdout(t *testing.T) {
+	stub := newStubAgile(t)
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	func() {
+		defer func() { os.Stdout = stdout }()
+		api := stub.api()
+		api.Debug = true
+		stub.Put("/dir/a.txt", []byte("a"))
+		api.ListFiles("/dir")
+		api.ListFilesDetails("/missing")
+		af := stub.agileFiles(api)
+		file, err := af.GetFile("/dir/a.txt")
+		if err == nil {
+			file.Rename("/dir/b.txt")
+		}
+		stub.Expire()
+		api.ReAuth()
+	}()
+	w.Close()
+	written, _ := io.ReadAll(r)
+	if len(written) != 0 {
+		t.Errorf("wrote to stdout: %q", written)
+	}
+}
@@ -0,0 +1,47 @@
+package agileapi
+
+import "time"
+
+// Metrics observes the traffic an AgileApi generates.  Implementations must
+// be safe for concurrent use.  See the agileprom package for a Prometheus
+// implementation.
+type Metrics interface {
+	// Request is called once every JSON-RPC call, upload or egress read
+	// has finished.
+	Request(stats RequestStats)
+	// Retry is called when a call is attempted again after a failure.
+	Retry(method string)
+	// ReAuth is called after the token has been refreshed, with the error
+	// from login if it failed.
+	ReAuth(err error)
+}
+
+// RequestStats describes one finished request.
+type RequestStats struct {
+	// Kind is "rpc", "upload" or "egress".
+	Kind string
+	// Method is the JSON-RPC method, "upload" or "egress".
+	Method   string
+	Duration time.Duration
+	// BytesOut is what was sent, BytesIn what was received.
+	BytesOut int64
+	BytesIn  int64
+	// Status is the HTTP status, 0 if no response was received.
+	Status int
+	// Code is the Agile result code where the response carried one.
+	Code int
+	Err  error
+}
+
+type noMetrics struct{}
+
+func (noMetrics) Request(RequestStats) {}
+func (noMetrics) Retry(string)         {}
+func (noMetrics) ReAuth(error)         {}
+
+func (me *AgileApi) metrics() Metrics {
+	if me.Metrics != nil {
+		return me.Metrics
+	}
+	return noMetrics{}
+}
@@ -0,0 +1,136 @@
+package agileapi
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingMetrics struct {
+	mu       sync.Mutex
+	requests []RequestStats
+	retries  []string
+	reauths  []error
+}
+
+func (me *recordingMetrics) Request(stats RequestStats) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.requests = append(me.requests, stats)
+}
+
+func (me *recordingMetrics) Retry(method string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.retries = append(me.retries, method)
+}
+
+func (me *recordingMetrics) ReAuth(err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.reauths = append(me.reauths, err)
+}
+
+// last returns the latest request of kind and method.
+func (me *recordingMetrics) last(kind, method string) (stats RequestStats, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, request := range me.requests {
+		if request.Kind == kind && request.Method == method {
+			stats, ok = request, true
+		}
+	}
+	return stats, ok
+}
+
+func (me *stubAgile) meteredApi(metrics Metrics) (*AgileApi, error) {
+	return NewWithConfig(Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        me.URL + "/jsonrpc",
+		TokenCache: filepath.Join(me.t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: me.Transport()},
+		Metrics:    metrics,
+	})
+}
+
+func TestMetricsRequests(t *testing.T) {
+	stub := newStubAgile(t)
+	metrics := &recordingMetrics{}
+	api, err := stub.meteredApi(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, ok := metrics.last("rpc", "login"); !ok || stats.Status != 200 || stats.BytesOut == 0 || stats.BytesIn == 0 {
+		t.Errorf("login: %+v, %v", stats, ok)
+	}
+
+	stub.Put("/a.txt", []byte("hello"))
+	api.StatFile("/a.txt")
+	if stats, ok := metrics.last("rpc", "stat"); !ok || stats.Code != 0 || stats.Status != 200 || stats.Duration <= 0 || stats.Err != nil {
+		t.Errorf("stat: %+v, %v", stats, ok)
+	}
+	api.StatFile("/missing")
+	if stats, _ := metrics.last("rpc", "stat"); stats.Code != -1 {
+		t.Errorf("stat of a missing file has code %d", stats.Code)
+	}
+
+	err = api.UploadFileStream("/", "b.txt", strings.NewReader("upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, ok := metrics.last("upload", "upload"); !ok || stats.BytesOut != int64(len("upload")) || stats.Status != 200 {
+		t.Errorf("upload: %+v, %v", stats, ok)
+	}
+
+	af := stub.agileFiles(api)
+	file, err := af.GetFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Contents(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, ok := metrics.last("egress", "egress"); !ok || stats.BytesIn != int64(len("hello")) || stats.Status != 200 || stats.Err != nil {
+		t.Errorf("egress: %+v, %v", stats, ok)
+	}
+	stub.Lock()
+	delete(stub.Uploads, "/a.txt")
+	stub.Unlock()
+	file.Contents()
+	if stats, ok := metrics.last("egress", "egress"); !ok || stats.Status != 404 || stats.Err == nil {
+		t.Errorf("egress of a missing file: %+v, %v", stats, ok)
+	}
+}
+
+func TestMetricsReAuthAndRetry(t *testing.T) {
+	stub := newStubAgile(t)
+	metrics := &recordingMetrics{}
+	api, err := stub.meteredApi(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Expire()
+	api.CheckAuth()
+	stub.Lock()
+	stub.FailLogins = true
+	stub.Unlock()
+	stub.Expire()
+	api.CheckAuth()
+	metrics.mu.Lock()
+	reauths := metrics.reauths
+	metrics.mu.Unlock()
+	if len(reauths) != 2 || reauths[0] != nil || reauths[1] == nil {
+		t.Errorf("reauths %v, want a success then a failure", reauths)
+	}
+
+	metrics = &recordingMetrics{}
+	if _, err = stub.meteredApi(metrics); err == nil {
+		t.Fatal("logged in while logins fail")
+	}
+	if len(metrics.retries) != 1 || metrics.retries[0] != "login" {
+		t.Errorf("retries %q, want [login]", metrics.retries)
+	}
+}
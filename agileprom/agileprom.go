@@ -0,0 +1,94 @@
+// Package agileprom exports agileapi Metrics to Prometheus.  It lives in its
+// own package so the core does not depend on the Prometheus client.
+//
+//	metrics := agileprom.New(prometheus.DefaultRegisterer, "agile")
+//	api, err := agileapi.NewWithConfig(agileapi.Config{..., Metrics: metrics})
+package agileprom
+
+import (
+	"strconv"
+
+	"github.com/Harnish/agileapi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Metrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	bytes    *prometheus.CounterVec
+	retries  *prometheus.CounterVec
+	reauths  *prometheus.CounterVec
+}
+
+var _ agileapi.Metrics = (*Metrics)(nil)
+
+// New creates the collectors and registers them with reg.  Metric names are
+// prefixed with namespace.
+func New(reg prometheus.Registerer, namespace string) *Metrics {
+	me := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests made to Agile, by kind, method and result code.",
+		}, []string{"kind", "method", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "request_errors_total",
+			Help:      "Requests to Agile that returned an error.",
+		}, []string{"kind", "method"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests to Agile.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"kind", "method"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Bytes sent to and received from Agile.",
+		}, []string{"kind", "direction"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "retries_total",
+			Help:      "Calls attempted again after a failure.",
+		}, []string{"method"}),
+		reauths: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reauths_total",
+			Help:      "Token refreshes, by outcome.",
+		}, []string{"result"}),
+	}
+	reg.MustRegister(me.requests, me.errors, me.duration, me.bytes, me.retries, me.reauths)
+	return me
+}
+
+func (me *Metrics) Request(stats agileapi.RequestStats) {
+	code := strconv.Itoa(stats.Code)
+	if stats.Kind != "rpc" {
+		code = strconv.Itoa(stats.Status)
+	}
+	me.requests.WithLabelValues(stats.Kind, stats.Method, code).Inc()
+	if stats.Err != nil {
+		me.errors.WithLabelValues(stats.Kind, stats.Method).Inc()
+	}
+	me.duration.WithLabelValues(stats.Kind, stats.Method).Observe(stats.Duration.Seconds())
+	if stats.BytesOut > 0 {
+		me.bytes.WithLabelValues(stats.Kind, "out").Add(float64(stats.BytesOut))
+	}
+	if stats.BytesIn > 0 {
+		me.bytes.WithLabelValues(stats.Kind, "in").Add(float64(stats.BytesIn))
+	}
+}
+
+func (me *Metrics) Retry(method string) {
+	me.retries.WithLabelValues(method).Inc()
+}
+
+func (me *Metrics) ReAuth(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	me.reauths.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,46 @@
+package agileprom
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Harnish/agileapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	me := New(reg, "agile")
+	me.Request(agileapi.RequestStats{Kind: "rpc", Method: "stat", Duration: time.Millisecond, BytesOut: 10, BytesIn: 20, Status: 200, Code: -1})
+	me.Request(agileapi.RequestStats{Kind: "egress", Method: "egress", BytesIn: 5, Status: 404, Err: errors.New("not found")})
+	me.Retry("login")
+	me.ReAuth(nil)
+	me.ReAuth(errors.New("failed"))
+
+	for _, tc := range []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{"requests rpc, stat, -1", me.requests.WithLabelValues("rpc", "stat", "-1"), 1},
+		// Egress has no Agile code, so it is counted by HTTP status.
+		{"requests egress, egress, 404", me.requests.WithLabelValues("egress", "egress", "404"), 1},
+		{"errors egress, egress", me.errors.WithLabelValues("egress", "egress"), 1},
+		{"errors rpc, stat", me.errors.WithLabelValues("rpc", "stat"), 0},
+		{"bytes rpc, out", me.bytes.WithLabelValues("rpc", "out"), 10},
+		{"bytes rpc, in", me.bytes.WithLabelValues("rpc", "in"), 20},
+		{"bytes egress, in", me.bytes.WithLabelValues("egress", "in"), 5},
+		{"retries login", me.retries.WithLabelValues("login"), 1},
+		{"reauths ok", me.reauths.WithLabelValues("ok"), 1},
+		{"reauths error", me.reauths.WithLabelValues("error"), 1},
+	} {
+		if got := testutil.ToFloat64(tc.collector); got != tc.want {
+			t.Errorf("%s is %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if n := testutil.CollectAndCount(me.duration, "agile_request_duration_seconds"); n != 2 {
+		t.Errorf("%d duration series, want 2", n)
+	}
+}
@@ -0,0 +1,425 @@
+// Package agiles3 is an HTTP gateway that speaks a subset of the S3 API on
+// top of AgileFiles, so tools like aws-cli and rclone can use Agile storage.
+//
+// Requests are path style (http://host/bucket/key).  Buckets are the
+// directories directly under Root.  Supported operations are ListBuckets,
+// HeadBucket, ListObjectsV2, GetObject (with Range), HeadObject, PutObject,
+// CopyObject, DeleteObject and multipart uploads.  ETags are the Agile
+// SHA-256 checksums, which listings leave empty when the AgileFiles has
+// Encryption set as they aren't of what reads give.
+package agiles3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Harnish/agileapi"
+)
+
+type Gateway struct {
+	Files *agileapi.AgileFiles
+	// Root is the Agile directory whose subdirectories are served as buckets.
+	Root string
+	// Keys maps access key ids to secret keys used for SigV4 verification.
+	Keys map[string]string
+	// TempDir holds multipart parts until the upload is completed.  Defaults
+	// to os.TempDir().
+	TempDir string
+	// UploadExpiry is how long a multipart upload may sit idle before its
+	// parts are discarded.  Defaults to 24 hours.
+	UploadExpiry time.Duration
+
+	uploads map[string]*multipartUpload
+	mu      sync.Mutex
+}
+
+func New(af *agileapi.AgileFiles, root string, keys map[string]string) *Gateway {
+	return &Gateway{
+		Files:   af,
+		Root:    root,
+		Keys:    keys,
+		uploads: map[string]*multipartUpload{},
+	}
+}
+
+func (me *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := me.verify(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	bucket, key := splitPath(r.URL.Path)
+	if !me.validPath(bucket, key) {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method == "GET" {
+			me.listBuckets(w, r)
+			return
+		}
+		writeError(w, r, errNotImplemented)
+		return
+	}
+	if key == "" {
+		switch r.Method {
+		case "GET":
+			if query.Get("list-type") == "2" {
+				me.listObjectsV2(w, r, bucket)
+				return
+			}
+		case "HEAD":
+			me.headBucket(w, r, bucket)
+			return
+		}
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		me.createMultipartUpload(w, r, bucket, key)
+	case r.Method == "PUT" && query.Has("uploadId"):
+		me.uploadPart(w, r, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == "POST" && query.Has("uploadId"):
+		me.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		me.abortMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		me.copyObject(w, r, bucket, key)
+	case r.Method == "PUT":
+		me.putObject(w, r, bucket, key)
+	case r.Method == "GET":
+		me.getObject(w, r, bucket, key, true)
+	case r.Method == "HEAD":
+		me.getObject(w, r, bucket, key, false)
+	case r.Method == "DELETE":
+		me.deleteObject(w, r, bucket, key)
+	default:
+		writeError(w, r, errNotImplemented)
+	}
+}
+
+func splitPath(urlpath string) (bucket, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(urlpath, "/"), "/", 2)
+	bucket = parts[0]
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	return
+}
+
+// agilePath maps a bucket and key onto an Agile path.  Callers check the
+// bucket and key with validPath first.
+func (me *Gateway) agilePath(bucket, key string) string {
+	return path.Join("/", me.Root, bucket, key)
+}
+
+// validPath reports whether bucket and key name something under Root: no
+// "." or ".." segments, and nothing that joins to a path outside it.
+func (me *Gateway) validPath(bucket, key string) bool {
+	if bucket == "" {
+		return key == ""
+	}
+	for _, segment := range append([]string{bucket}, strings.Split(key, "/")...) {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	root := path.Join("/", me.Root)
+	if root != "/" {
+		root += "/"
+	}
+	return strings.HasPrefix(me.agilePath(bucket, key), root)
+}
+
+// stat returns nil when path does not exist or is a directory.
+func (me *Gateway) stat(mypath string) (*agileapi.StatResult, error) {
+	stat, err := me.Files.AgileApi.StatFile(mypath)
+	if err != nil {
+		return nil, err
+	}
+	err = stat.Err(mypath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && stat.Type == 1) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+func (me *Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	var result struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct{ ID string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}
+	result.Owner.ID = me.Files.AgileApi.Username
+	dirs, err := me.Files.AgileApi.ListDirsDetails(path.Join("/", me.Root))
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	for _, dir := range dirs {
+		result.Buckets = append(result.Buckets, bucket{Name: dir.Filename, CreationDate: isoTime(unixTime(dir.Stat.Mtime))})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (me *Gateway) headBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	bucketpath := me.agilePath(bucket, "")
+	stat, err := me.Files.AgileApi.StatFile(bucketpath)
+	if err == nil {
+		err = stat.Err(bucketpath)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	if err != nil || stat.Type != 1 {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (me *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string, body bool) {
+	mypath := me.agilePath(bucket, key)
+	stat, err := me.stat(mypath)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	if stat == nil {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+	size, err := me.Files.PlainSize(mypath, int64(stat.Size))
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	h := w.Header()
+	h.Set("ETag", `"`+stat.Checksum+`"`)
+	h.Set("Last-Modified", unixTime(stat.Mtime).UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if stat.MimeType != "" {
+		h.Set("Content-Type", stat.MimeType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+
+	status := http.StatusOK
+	offset, length := int64(0), size
+	if rng := r.Header.Get("Range"); rng != "" {
+		var ok bool
+		offset, length, ok = agileapi.ParseRange(rng, size)
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, r, errInvalidRange)
+			return
+		}
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	}
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if !body || length == 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	file, err := me.Files.GetFile(mypath)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	reader, err := file.NewRangeReader(offset, length)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	defer reader.Close()
+	w.WriteHeader(status)
+	io.Copy(w, reader)
+}
+
+func (me *Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	mypath := me.agilePath(bucket, key)
+	if strings.HasSuffix(key, "/") && r.ContentLength == 0 {
+		// zero length "folder" objects become directories
+		err := me.Files.AgileApi.MkDir2(mypath)
+		if err != nil {
+			writeError(w, r, errInternal(err))
+			return
+		}
+		w.Header().Set("ETag", `""`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sha, serr := me.upload(mypath, payload(r), r.Header.Get("X-Amz-Content-Sha256"))
+	if serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	w.Header().Set("ETag", `"`+sha+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// upload streams data into mypath through a temp name, so a failed or
+// mismatching upload leaves any object already there alone.  When the
+// client sent a payload hash it is compared with the SHA-256 of the data,
+// before any encryption, and a mismatch fails the upload before the temp
+// is renamed into place.  The sha returned is of what is stored.
+func (me *Gateway) upload(mypath string, data io.Reader, expected string) (string, *s3Error) {
+	dir, filename := path.Split(mypath)
+	checked := &digestReader{r: data, hash: sha256.New()}
+	if len(expected) == 64 {
+		checked.expected = expected
+	}
+	sha, err := me.Files.UploadFileStreamReturnShaWithOptions(dir, filename, checked, 0, false, &agileapi.UploadOptions{Atomic: true})
+	if checked.mismatch {
+		return "", errBadDigest
+	}
+	if err != nil {
+		return "", errInternal(err)
+	}
+	return sha, nil
+}
+
+// digestReader fails at EOF when what was read doesn't hash to expected.
+type digestReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+	mismatch bool
+}
+
+func (me *digestReader) Read(p []byte) (int, error) {
+	n, err := me.r.Read(p)
+	me.hash.Write(p[:n])
+	if err == io.EOF && me.expected != "" && hex.EncodeToString(me.hash.Sum(nil)) != me.expected {
+		me.mismatch = true
+		err = fmt.Errorf("agiles3: payload does not match x-amz-content-sha256")
+	}
+	return n, err
+}
+
+// payload returns the request body, decoding aws-chunked uploads.  Chunk
+// signatures are not checked; the seed signature on the headers is.
+func payload(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return newChunkedReader(r.Body)
+	}
+	return r.Body
+}
+
+func (me *Gateway) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := urlUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+	srcbucket, srckey := splitPath("/" + strings.TrimPrefix(source, "/"))
+	if srckey == "" || !me.validPath(srcbucket, srckey) {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+	srcpath := me.agilePath(srcbucket, srckey)
+	stat, err := me.stat(srcpath)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	if stat == nil {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+	file, err := me.Files.GetFile(srcpath)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	reader, err := file.NewRangeReader(0, -1)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	defer reader.Close()
+	// The source's checksum is of its ciphertext when encrypted, and
+	// decrypting has already authenticated it.
+	expected := stat.Checksum
+	if me.Files.AgileApi.Encryption != nil {
+		expected = ""
+	}
+	sha, serr := me.upload(me.agilePath(bucket, key), reader, expected)
+	if serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	var result struct {
+		XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}
+	result.ETag = `"` + sha + `"`
+	result.LastModified = isoTime(time.Now())
+	writeXML(w, http.StatusOK, result)
+}
+
+func (me *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	mypath := me.agilePath(bucket, key)
+	stat, err := me.stat(mypath)
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	// S3 answers 204 whether or not the key existed.
+	if stat != nil {
+		err = me.Files.AgileApi.RmFile(mypath)
+		if err != nil {
+			writeError(w, r, errInternal(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (me *Gateway) tempDir() string {
+	if me.TempDir != "" {
+		return me.TempDir
+	}
+	return os.TempDir()
+}
+
+func isoTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,138 @@
+package agiles3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Harnish/agileapi"
+	"github.com/Harnish/agileapi/internal/agilestub"
+)
+
+const (
+	testKeyId  = "AKIDEXAMPLE"
+	testSecret = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// sign adds a SigV4 Authorization header to r, as a client would.
+func sign(r *http.Request, keyid, secret string, when time.Time) {
+	amzdate := when.UTC().Format(amzDateFormat)
+	scope := amzdate[:8] + "/us-east-1/s3/aws4_request"
+	r.Header.Set("X-Amz-Date", amzdate)
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		signedHeaders += ";x-amz-copy-source"
+	}
+	sum := sha256.Sum256([]byte(canonicalRequest(r, signedHeaders, unsignedPayload, false)))
+	tosign := strings.Join([]string{sigv4Algorithm, amzdate, scope, hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	r.Header.Set("Authorization", sigv4Algorithm+" Credential="+keyid+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, tosign)))
+}
+
+// testGateway has no Files, so any request that gets as far as Agile panics.
+func testGateway() *Gateway {
+	return New(nil, "/s3", map[string]string{testKeyId: testSecret})
+}
+
+// stubGateway is a gateway serving /s3 on an Agile stub.
+func stubGateway(t *testing.T) (*Gateway, *agilestub.Server) {
+	stub := agilestub.New(t)
+	api, err := agileapi.NewWithConfig(agileapi.Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        stub.URL + "/jsonrpc",
+		TokenCache: filepath.Join(t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: stub.Transport()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := New(&agileapi.AgileFiles{AgileApi: api, EgressURL: stub.URL + "/egress"}, "/s3", map[string]string{testKeyId: testSecret})
+	gw.TempDir = t.TempDir()
+	return gw, stub
+}
+
+// do signs and serves a request.
+func do(gw *Gateway, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://gateway"+target, strings.NewReader(body))
+	sign(r, testKeyId, testSecret, time.Now())
+	return serve(gw, r)
+}
+
+func serve(gw *Gateway, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, r)
+	return w
+}
+
+func TestTraversalRejected(t *testing.T) {
+	gw := testGateway()
+	for _, target := range []string{
+		"/../etc/passwd",
+		"/bucket/../../etc/passwd",
+		"/bucket/a/../../../x",
+		"/bucket/./x",
+		"/bucket/%2e%2e/%2e%2e/x",
+		"/../",
+	} {
+		r := httptest.NewRequest("GET", "http://gateway"+target, nil)
+		sign(r, testKeyId, testSecret, time.Now())
+		w := serve(gw, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "InvalidArgument") {
+			t.Errorf("GET %s: %d %s", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCopySourceTraversalRejected(t *testing.T) {
+	gw := testGateway()
+	for _, source := range []string{
+		"b/../../x",
+		"/b/../../x",
+		"../x/y",
+		"b/%2e%2e/%2e%2e/x",
+		"b/./x",
+		"b",
+	} {
+		r := httptest.NewRequest("PUT", "http://gateway/bucket/key", nil)
+		r.Header.Set("X-Amz-Copy-Source", source)
+		sign(r, testKeyId, testSecret, time.Now())
+		w := serve(gw, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "InvalidArgument") {
+			t.Errorf("copy from %q: %d %s", source, w.Code, w.Body)
+		}
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	for _, tc := range []struct {
+		root, bucket, key string
+		ok                bool
+	}{
+		{"/s3", "", "", true},
+		{"/s3", "bucket", "", true},
+		{"/s3", "bucket", "a/b.txt", true},
+		{"/s3", "bucket", "a..b/..c", true},
+		{"/s3", "..", "", false},
+		{"/s3", ".", "x", false},
+		{"/s3", "bucket", "a/../../b", false},
+		{"/s3", "", "key", false},
+		{"/", "bucket", "key", true},
+		{"", "bucket", "..", false},
+	} {
+		gw := &Gateway{Root: tc.root}
+		if ok := gw.validPath(tc.bucket, tc.key); ok != tc.ok {
+			t.Errorf("validPath(%q, %q) under %q = %v", tc.bucket, tc.key, tc.root, ok)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package agiles3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// chunkedReader decodes an aws-chunked body:
+//
+//	<hex size>;chunk-signature=<sig>\r\n<data>\r\n ... 0;chunk-signature=<sig>\r\n[trailers]\r\n
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func newChunkedReader(r io.Reader) io.Reader {
+	return &chunkedReader{r: bufio.NewReader(r)}
+}
+
+func (me *chunkedReader) Read(p []byte) (int, error) {
+	if me.done {
+		return 0, io.EOF
+	}
+	if me.left == 0 {
+		line, err := me.r.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("agiles3: bad aws-chunked header: %s", err)
+		}
+		size := strings.TrimSpace(line)
+		if i := strings.Index(size, ";"); i >= 0 {
+			size = size[:i]
+		}
+		me.left, err = strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("agiles3: bad aws-chunked size %q", size)
+		}
+		if me.left == 0 {
+			// trailers are not used, drain them
+			me.done = true
+			io.Copy(io.Discard, me.r)
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > me.left {
+		p = p[:me.left]
+	}
+	n, err := me.r.Read(p)
+	me.left -= int64(n)
+	if me.left == 0 && err == nil {
+		if _, err := me.r.Discard(2); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
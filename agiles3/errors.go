@@ -0,0 +1,57 @@
+package agiles3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+)
+
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+var (
+	errAccessDenied                 = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errAuthorizationHeaderMalformed = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errInvalidAccessKeyId           = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key Id you provided does not exist in our records"}
+	errSignatureDoesNotMatch        = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errRequestTimeTooSkewed         = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errExpiredToken                 = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errNoSuchBucket                 = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey                    = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errNoSuchUpload                 = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errInvalidPart                  = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errInvalidPartOrder             = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errInvalidRange                 = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	errInvalidArgument              = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	errMalformedXML                 = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	errBadDigest                    = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errNotImplemented               = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or operation you provided is not implemented"}
+)
+
+func errInternal(err error) *s3Error {
+	return &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err *s3Error) {
+	var body struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}
+	body.Code = err.Code
+	body.Message = err.Message
+	body.Resource = r.URL.Path
+	if r.Method == "HEAD" {
+		w.WriteHeader(err.Status)
+		return
+	}
+	writeXML(w, err.Status, body)
+}
+
+func urlUnescape(s string) (string, error) {
+	return url.PathUnescape(s)
+}
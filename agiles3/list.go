@@ -0,0 +1,248 @@
+package agiles3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Harnish/agileapi"
+)
+
+type listObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         uint64
+	StorageClass string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []listObject
+	CommonPrefixes        []listPrefix
+}
+
+// listObjectsV2 serves ListObjectsV2.  With delimiter "/" a page maps onto
+// one listFile call and the continuation token carries its cookie; the
+// directories of the prefix are returned as common prefixes on the first
+// page.  Without a delimiter the tree is walked and the token is the last
+// key returned.
+func (me *Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	result := listResult{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           1000,
+	}
+	if maxkeys := query.Get("max-keys"); maxkeys != "" {
+		n, err := strconv.Atoi(maxkeys)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		if n < result.MaxKeys {
+			result.MaxKeys = n
+		}
+	}
+	bucketpath := me.agilePath(bucket, "")
+	stat, err := me.Files.AgileApi.StatFile(bucketpath)
+	if err == nil {
+		err = stat.Err(bucketpath)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	if err != nil || stat.Type != 1 {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	var serr *s3Error
+	if result.Delimiter == "/" {
+		serr = me.listDelimited(&result, bucketpath)
+	} else if result.Delimiter == "" {
+		serr = me.listRecursive(&result, bucketpath)
+	} else {
+		serr = errNotImplemented
+	}
+	if serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, http.StatusOK, result)
+}
+
+func (me *Gateway) listDelimited(result *listResult, bucketpath string) *s3Error {
+	dirprefix, nameprefix := "", result.Prefix
+	if i := strings.LastIndex(result.Prefix, "/"); i >= 0 {
+		dirprefix, nameprefix = result.Prefix[:i+1], result.Prefix[i+1:]
+	}
+	dir := path.Join(bucketpath, dirprefix)
+
+	cookie := 0
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		cookie, err = strconv.Atoi(string(token))
+		if err != nil {
+			return errInvalidArgument
+		}
+	} else {
+		dirs, err := me.Files.AgileApi.ListDirsDetails(dir)
+		if errors.Is(err, fs.ErrNotExist) && dirprefix != "" {
+			// A prefix naming a directory that isn't there matches nothing.
+			return nil
+		}
+		if err != nil {
+			return errInternal(err)
+		}
+		for _, d := range dirs {
+			if strings.HasPrefix(d.Filename, nameprefix) {
+				result.CommonPrefixes = append(result.CommonPrefixes, listPrefix{Prefix: dirprefix + d.Filename + "/"})
+			}
+		}
+	}
+	if result.MaxKeys == 0 {
+		return nil
+	}
+
+	files, next, err := me.Files.ListFilesPage(dir, result.MaxKeys, cookie)
+	if errors.Is(err, fs.ErrNotExist) && dirprefix != "" {
+		return nil
+	}
+	if err != nil {
+		return errInternal(err)
+	}
+	for _, f := range files {
+		key := dirprefix + f.Filename
+		if agileapi.IsAtomicTemp(f.Filename) || !strings.HasPrefix(f.Filename, nameprefix) || (result.StartAfter != "" && key <= result.StartAfter) {
+			continue
+		}
+		result.Contents = append(result.Contents, objectFromList(key, f))
+	}
+	if next != 0 && len(files) > 0 {
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(next)))
+	}
+	return nil
+}
+
+func (me *Gateway) listRecursive(result *listResult, bucketpath string) *s3Error {
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		after = string(token)
+	}
+	// Only descend into the directory part of the prefix.
+	dirprefix := ""
+	if i := strings.LastIndex(result.Prefix, "/"); i >= 0 {
+		dirprefix = result.Prefix[:i+1]
+	}
+	// The walk visits files and subdirectories in key order, so it can stop
+	// once it has a page and skip subdirectories that sort before after.
+	type entry struct {
+		key  string
+		item agileapi.Filestruct
+	}
+	var keys []listObject
+	var walk func(dir, keyprefix string) error
+	walk = func(dir, keyprefix string) error {
+		listing, err := me.Files.List(dir)
+		if err != nil {
+			return err
+		}
+		entries := make([]entry, 0, len(listing))
+		for _, f := range listing {
+			if f.IsDir {
+				entries = append(entries, entry{key: keyprefix + f.Filename + "/", item: f})
+			} else if !agileapi.IsAtomicTemp(f.Filename) {
+				entries = append(entries, entry{key: keyprefix + f.Filename, item: f})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		for _, e := range entries {
+			if len(keys) > result.MaxKeys {
+				return nil
+			}
+			if !e.item.IsDir {
+				if strings.HasPrefix(e.key, result.Prefix) && e.key > after {
+					keys = append(keys, objectFromList(e.key, e.item))
+				}
+				continue
+			}
+			if !strings.HasPrefix(e.key, result.Prefix) && !strings.HasPrefix(result.Prefix, e.key) {
+				continue
+			}
+			if after > e.key && !strings.HasPrefix(after, e.key) {
+				// Every key under e sorts before after.
+				continue
+			}
+			err = walk(path.Join(dir, e.item.Filename), e.key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(path.Join(bucketpath, dirprefix), dirprefix)
+	if errors.Is(err, fs.ErrNotExist) && dirprefix != "" {
+		// A prefix naming a directory that isn't there matches nothing.
+		err = nil
+	}
+	if err != nil {
+		return errInternal(err)
+	}
+	if len(keys) > result.MaxKeys {
+		keys = keys[:result.MaxKeys]
+		result.IsTruncated = true
+		if len(keys) > 0 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1].Key))
+		}
+	}
+	result.Contents = keys
+	return nil
+}
+
+func objectFromList(key string, f agileapi.Filestruct) listObject {
+	return listObject{
+		Key:          key,
+		LastModified: isoTime(f.Mtime),
+		ETag:         `"` + f.Sha256 + `"`,
+		Size:         f.Size,
+		StorageClass: "STANDARD",
+	}
+}
+
+func unixTime(t int) time.Time {
+	return time.Unix(int64(t), 0)
+}
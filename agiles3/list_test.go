@@ -0,0 +1,107 @@
+package agiles3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/Harnish/agileapi"
+)
+
+func listPage(t *testing.T, gw *Gateway, query url.Values) listResult {
+	t.Helper()
+	query.Set("list-type", "2")
+	w := do(gw, "GET", "/b?"+query.Encode(), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list %v: %d %s", query, w.Code, w.Body)
+	}
+	var result listResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestListRecursivePages(t *testing.T) {
+	gw, stub := stubGateway(t)
+	for _, name := range []string{"a.txt", "a/x", "a/y/z", "a0", "b", ".agile-tmp-1-b", "a/.agile-tmp-2-x"} {
+		stub.Put("/s3/b/"+name, []byte(name))
+	}
+
+	var keys []string
+	query := url.Values{"max-keys": {"2"}}
+	for page := 0; ; page++ {
+		if page == 2 {
+			// Everything under a/ is before this page's marker, so the
+			// walk must not list it again.
+			stub.Lock()
+			stub.ListCodes["/s3/b/a"] = -5
+			stub.Unlock()
+		}
+		result := listPage(t, gw, query)
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	want := []string{"a.txt", "a/x", "a/y/z", "a0", "b"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("listed %q, want %q", keys, want)
+	}
+}
+
+func TestListRecursivePrefix(t *testing.T) {
+	gw, stub := stubGateway(t)
+	for _, name := range []string{"a/x", "a/y/z", "ab", "c/d"} {
+		stub.Put("/s3/b/"+name, []byte(name))
+	}
+	var keys []string
+	for _, object := range listPage(t, gw, url.Values{"prefix": {"a"}}).Contents {
+		keys = append(keys, object.Key)
+	}
+	want := []string{"a/x", "a/y/z", "ab"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("listed %q, want %q", keys, want)
+	}
+}
+
+func TestListDelimitedHidesAtomicTemps(t *testing.T) {
+	gw, stub := stubGateway(t)
+	for _, name := range []string{"f", ".agile-tmp-1-f", "d/g"} {
+		stub.Put("/s3/b/"+name, []byte(name))
+	}
+	result := listPage(t, gw, url.Values{"delimiter": {"/"}})
+	var keys []string
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"f"}) {
+		t.Errorf("listed %q, want [f]", keys)
+	}
+	if len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != "d/" {
+		t.Errorf("prefixes %v, want [d/]", result.CommonPrefixes)
+	}
+}
+
+func TestListEncryptedSizes(t *testing.T) {
+	gw, stub := stubGateway(t)
+	gw.Files.AgileApi.Encryption = &agileapi.StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)}}
+	if w := do(gw, "PUT", "/b/d/k", "hello world"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if data, _ := stub.Contents("/s3/b/d/k"); len(data) == len("hello world") {
+		t.Fatal("stored unencrypted")
+	}
+	for _, query := range []url.Values{{}, {"delimiter": {"/"}, "prefix": {"d/"}}} {
+		result := listPage(t, gw, query)
+		if len(result.Contents) != 1 || result.Contents[0].Size != uint64(len("hello world")) {
+			t.Errorf("list %v: %+v", query, result.Contents)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package agiles3
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// multipartUpload stages parts in temp files.  Agile has no multipart
+// upload of its own, so completing one streams the parts in order into a
+// single UploadFileStream.
+type multipartUpload struct {
+	bucket string
+	key    string
+	parts  map[int]*part
+	// touched is when the upload was last used, for expiry.
+	touched time.Time
+}
+
+// defaultUploadExpiry is used when Gateway.UploadExpiry is zero.
+const defaultUploadExpiry = 24 * time.Hour
+
+type part struct {
+	file string
+	etag string
+}
+
+func (me *Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	me.expire()
+	upload := &multipartUpload{bucket: bucket, key: key, parts: map[int]*part{}, touched: time.Now()}
+	me.mu.Lock()
+	if me.uploads == nil {
+		me.uploads = map[string]*multipartUpload{}
+	}
+	me.uploads[hex.EncodeToString(id)] = upload
+	me.mu.Unlock()
+
+	var result struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}
+	result.Bucket = bucket
+	result.Key = key
+	result.UploadId = hex.EncodeToString(id)
+	writeXML(w, http.StatusOK, result)
+}
+
+// pending returns the upload id if it is for bucket and key and hasn't
+// expired.
+func (me *Gateway) pending(id, bucket, key string) *multipartUpload {
+	me.expire()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	upload := me.uploads[id]
+	if upload == nil || upload.bucket != bucket || upload.key != key {
+		return nil
+	}
+	upload.touched = time.Now()
+	return upload
+}
+
+// expire discards uploads that have been idle for longer than UploadExpiry.
+func (me *Gateway) expire() {
+	expiry := me.UploadExpiry
+	if expiry <= 0 {
+		expiry = defaultUploadExpiry
+	}
+	cutoff := time.Now().Add(-expiry)
+	var stale []string
+	me.mu.Lock()
+	for id, upload := range me.uploads {
+		if upload.touched.Before(cutoff) {
+			stale = append(stale, id)
+		}
+	}
+	me.mu.Unlock()
+	for _, id := range stale {
+		me.discard(id)
+	}
+}
+
+func (me *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, id, number string) {
+	upload := me.pending(id, bucket, key)
+	if upload == nil {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+	tmp, err := os.CreateTemp(me.tempDir(), "agiles3-part-")
+	if err != nil {
+		writeError(w, r, errInternal(err))
+		return
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), payload(r))
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		writeError(w, r, errInternal(err))
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected := r.Header.Get("X-Amz-Content-Sha256"); len(expected) == 64 && expected != sum {
+		os.Remove(tmp.Name())
+		writeError(w, r, errBadDigest)
+		return
+	}
+
+	me.mu.Lock()
+	if old, ok := upload.parts[n]; ok {
+		os.Remove(old.file)
+	}
+	upload.parts[n] = &part{file: tmp.Name(), etag: sum}
+	me.mu.Unlock()
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (me *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	upload := me.pending(id, bucket, key)
+	if upload == nil {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	var readers []io.Reader
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	last := 0
+	me.mu.Lock()
+	for _, p := range request.Parts {
+		if p.PartNumber <= last {
+			me.mu.Unlock()
+			writeError(w, r, errInvalidPartOrder)
+			return
+		}
+		last = p.PartNumber
+		staged, ok := upload.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != staged.etag {
+			me.mu.Unlock()
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		f, err := os.Open(staged.file)
+		if err != nil {
+			me.mu.Unlock()
+			writeError(w, r, errInternal(err))
+			return
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	me.mu.Unlock()
+
+	sha, serr := me.upload(me.agilePath(bucket, key), io.MultiReader(readers...), "")
+	if serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	me.discard(id)
+
+	var result struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}
+	result.Bucket = bucket
+	result.Key = key
+	result.ETag = `"` + sha + `"`
+	writeXML(w, http.StatusOK, result)
+}
+
+func (me *Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	if me.pending(id, bucket, key) == nil {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	me.discard(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discard forgets an upload and removes its staged parts.
+func (me *Gateway) discard(id string) {
+	me.mu.Lock()
+	upload := me.uploads[id]
+	delete(me.uploads, id)
+	me.mu.Unlock()
+	if upload == nil {
+		return
+	}
+	for _, p := range upload.parts {
+		os.Remove(p.file)
+	}
+}
@@ -0,0 +1,86 @@
+package agiles3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createUpload(t *testing.T, gw *Gateway, target string) string {
+	t.Helper()
+	w := do(gw, "POST", target+"?uploads", "")
+	var result struct{ UploadId string }
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.UploadId == "" {
+		t.Fatalf("create %s: %d %s", target, w.Code, w.Body)
+	}
+	return result.UploadId
+}
+
+func TestMultipartUpload(t *testing.T) {
+	gw, stub := stubGateway(t)
+	id := createUpload(t, gw, "/b/k")
+	var etags []string
+	for i, data := range []string{"hello ", "world"} {
+		w := do(gw, "PUT", "/b/k?partNumber="+strconv.Itoa(i+1)+"&uploadId="+id, data)
+		if w.Code != http.StatusOK {
+			t.Fatalf("part %d: %d %s", i+1, w.Code, w.Body)
+		}
+		etags = append(etags, w.Header().Get("ETag"))
+	}
+	body := "<CompleteMultipartUpload>" +
+		"<Part><PartNumber>1</PartNumber><ETag>" + etags[0] + "</ETag></Part>" +
+		"<Part><PartNumber>2</PartNumber><ETag>" + etags[1] + "</ETag></Part>" +
+		"</CompleteMultipartUpload>"
+	if w := do(gw, "POST", "/b/k?uploadId="+id, body); w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if data, _ := stub.Contents("/s3/b/k"); string(data) != "hello world" {
+		t.Errorf("stored %q", data)
+	}
+}
+
+func TestMultipartUploadIsForItsKey(t *testing.T) {
+	gw, _ := stubGateway(t)
+	id := createUpload(t, gw, "/b/k")
+	for _, target := range []string{"/b/other", "/other/k"} {
+		w := do(gw, "PUT", target+"?partNumber=1&uploadId="+id, "data")
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchUpload") {
+			t.Errorf("part for %s: %d %s", target, w.Code, w.Body)
+		}
+		w = do(gw, "DELETE", target+"?uploadId="+id, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("abort for %s: %d %s", target, w.Code, w.Body)
+		}
+	}
+	if gw.pending(id, "b", "k") == nil {
+		t.Error("upload was discarded by a request for another key")
+	}
+}
+
+func TestMultipartUploadExpires(t *testing.T) {
+	gw, _ := stubGateway(t)
+	gw.UploadExpiry = time.Hour
+	id := createUpload(t, gw, "/b/k")
+	if w := do(gw, "PUT", "/b/k?partNumber=1&uploadId="+id, "data"); w.Code != http.StatusOK {
+		t.Fatalf("part: %d %s", w.Code, w.Body)
+	}
+	gw.mu.Lock()
+	gw.uploads[id].touched = time.Now().Add(-2 * time.Hour)
+	gw.mu.Unlock()
+
+	w := do(gw, "PUT", "/b/k?partNumber=2&uploadId="+id, "more")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("part after expiry: %d %s", w.Code, w.Body)
+	}
+	staged, err := os.ReadDir(gw.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 0 {
+		t.Errorf("%d staged parts left after expiry", len(staged))
+	}
+}
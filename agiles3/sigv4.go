@@ -0,0 +1,176 @@
+package agiles3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigv4Algorithm  = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+	maxClockSkew    = 15 * time.Minute
+)
+
+// verify checks the SigV4 signature on r, either in the Authorization header
+// or in presigned query parameters, against the configured keys.
+func (me *Gateway) verify(r *http.Request) *s3Error {
+	query := r.URL.Query()
+	var (
+		credential    string
+		signedHeaders string
+		signature     string
+		amzdate       string
+		payloadhash   string
+		presigned     bool
+	)
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, sigv4Algorithm+" ") {
+		for _, part := range strings.Split(strings.TrimPrefix(auth, sigv4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzdate = r.Header.Get("X-Amz-Date")
+		payloadhash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadhash == "" {
+			payloadhash = unsignedPayload
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigv4Algorithm {
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzdate = query.Get("X-Amz-Date")
+		payloadhash = unsignedPayload
+	} else {
+		return errAccessDenied
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return errAuthorizationHeaderMalformed
+	}
+
+	// Credential is AKID/yyyymmdd/region/s3/aws4_request
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 {
+		return errAuthorizationHeaderMalformed
+	}
+	secret, ok := me.Keys[scope[0]]
+	if !ok {
+		return errInvalidAccessKeyId
+	}
+	scopeparts := strings.Split(scope[1], "/")
+	if len(scopeparts) != 4 || scopeparts[2] != "s3" || scopeparts[3] != "aws4_request" {
+		return errAuthorizationHeaderMalformed
+	}
+
+	signed, err := time.Parse(amzDateFormat, amzdate)
+	if err != nil {
+		return errAuthorizationHeaderMalformed
+	}
+	now := time.Now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || now.After(signed.Add(time.Duration(expires)*time.Second)) {
+			return errExpiredToken
+		}
+	} else if now.Sub(signed) > maxClockSkew || signed.Sub(now) > maxClockSkew {
+		return errRequestTimeTooSkewed
+	}
+
+	canonical := canonicalRequest(r, signedHeaders, payloadhash, presigned)
+	sum := sha256.Sum256([]byte(canonical))
+	tosign := strings.Join([]string{sigv4Algorithm, amzdate, scope[1], hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), scopeparts[0])
+	key = hmacSHA256(key, scopeparts[1])
+	key = hmacSHA256(key, scopeparts[2])
+	key = hmacSHA256(key, scopeparts[3])
+	expected := hex.EncodeToString(hmacSHA256(key, tosign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+func canonicalRequest(r *http.Request, signedHeaders, payloadhash string, presigned bool) string {
+	var headers []string
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			for i := range values {
+				values[i] = strings.Join(strings.Fields(values[i]), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers = append(headers, name+":"+value+"\n")
+	}
+
+	query := r.URL.Query()
+	if presigned {
+		query.Del("X-Amz-Signature")
+	}
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	uri := r.URL.EscapedPath()
+	if unescaped, err := url.PathUnescape(uri); err == nil {
+		uri = uriEncode(unescaped, false)
+	}
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		signedHeaders,
+		payloadhash,
+	}, "\n")
+}
+
+// uriEncode is the SigV4 flavour of percent encoding: everything except
+// unreserved characters is escaped, and "/" only when encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
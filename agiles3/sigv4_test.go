@@ -0,0 +1,128 @@
+package agiles3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presign adds SigV4 query parameters to r, valid for expires.
+func presign(r *http.Request, keyid, secret string, when time.Time, expires time.Duration) {
+	amzdate := when.UTC().Format(amzDateFormat)
+	scope := amzdate[:8] + "/us-east-1/s3/aws4_request"
+	query := r.URL.Query()
+	query.Set("X-Amz-Algorithm", sigv4Algorithm)
+	query.Set("X-Amz-Credential", keyid+"/"+scope)
+	query.Set("X-Amz-Date", amzdate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	r.URL.RawQuery = query.Encode()
+	sum := sha256.Sum256([]byte(canonicalRequest(r, "host", unsignedPayload, true)))
+	tosign := strings.Join([]string{sigv4Algorithm, amzdate, scope, hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	query.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(key, tosign)))
+	r.URL.RawQuery = query.Encode()
+}
+
+func TestVerify(t *testing.T) {
+	gw := testGateway()
+	for _, tc := range []struct {
+		name string
+		req  func() *http.Request
+		want *s3Error
+	}{
+		{"signed", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, testKeyId, testSecret, time.Now())
+			return r
+		}, nil},
+		{"tampered header", func() *http.Request {
+			r := httptest.NewRequest("PUT", "http://gateway/b/k", nil)
+			r.Header.Set("X-Amz-Copy-Source", "b/public")
+			sign(r, testKeyId, testSecret, time.Now())
+			r.Header.Set("X-Amz-Copy-Source", "b/secret")
+			return r
+		}, errSignatureDoesNotMatch},
+		{"tampered path", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, testKeyId, testSecret, time.Now())
+			r.URL.Path = "/b/other"
+			return r
+		}, errSignatureDoesNotMatch},
+		{"old date", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, testKeyId, testSecret, time.Now().Add(-time.Hour))
+			return r
+		}, errRequestTimeTooSkewed},
+		{"future date", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, testKeyId, testSecret, time.Now().Add(time.Hour))
+			return r
+		}, errRequestTimeTooSkewed},
+		{"wrong access key", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, "AKIDUNKNOWN", testSecret, time.Now())
+			return r
+		}, errInvalidAccessKeyId},
+		{"wrong secret", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			sign(r, testKeyId, "not the secret", time.Now())
+			return r
+		}, errSignatureDoesNotMatch},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest("GET", "http://gateway/b/k", nil)
+		}, errAccessDenied},
+		{"presigned", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			presign(r, testKeyId, testSecret, time.Now(), time.Hour)
+			return r
+		}, nil},
+		{"presigned and expired", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			presign(r, testKeyId, testSecret, time.Now().Add(-2*time.Hour), time.Hour)
+			return r
+		}, errExpiredToken},
+		{"presigned for another key", func() *http.Request {
+			r := httptest.NewRequest("GET", "http://gateway/b/k", nil)
+			presign(r, testKeyId, testSecret, time.Now(), time.Hour)
+			r.URL.Path = "/b/other"
+			return r
+		}, errSignatureDoesNotMatch},
+	} {
+		if got := gw.verify(tc.req()); got != tc.want {
+			t.Errorf("%s: verify = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestCanonicalRequest checks against the GET Object example in the AWS
+// SigV4 documentation.
+func TestCanonicalRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	r.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	r.Header.Set("X-Amz-Date", "20130524T000000Z")
+	got := canonicalRequest(r, "host;range;x-amz-content-sha256;x-amz-date", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", false)
+	want := "GET\n/test.txt\n\n" +
+		"host:examplebucket.s3.amazonaws.com\n" +
+		"range:bytes=0-9\n" +
+		"x-amz-content-sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n" +
+		"x-amz-date:20130524T000000Z\n\n" +
+		"host;range;x-amz-content-sha256;x-amz-date\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got != want {
+		t.Errorf("canonical request:\n%s\nwant:\n%s", got, want)
+	}
+	sum := sha256.Sum256([]byte(got))
+	if hex.EncodeToString(sum[:]) != "7344ae5b7ee6c3e7e6b0fe0640412a37625d1fbfff95c48bbb2dc43964946972" {
+		t.Errorf("canonical request hash %x", sum)
+	}
+}
@@ -0,0 +1,49 @@
+package agileapi
+
+import "sync"
+
+// session holds the token an AgileApi shares with the copies WithContext
+// makes of it.  Only the root's is used.  login is held while logging in so
+// concurrent callers that find the token expired only log in once.
+type session struct {
+	mu    sync.Mutex
+	token string
+	login sync.Mutex
+}
+
+// sessionInit guards creating the root's session for AgileApi values built
+// without NewWithConfig, which only get one on first use.
+var sessionInit sync.Mutex
+
+func (me *AgileApi) sharedSession() *session {
+	root := me.base()
+	if root.seeded {
+		return root.session
+	}
+	sessionInit.Lock()
+	defer sessionInit.Unlock()
+	if root.session == nil {
+		root.session = &session{token: root.Token}
+	}
+	return root.session
+}
+
+// token is the session token to send with a call.
+func (me *AgileApi) token() string {
+	s := me.sharedSession()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+func (me *AgileApi) setToken(token string) {
+	s := me.sharedSession()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// SessionToken is the token calls are currently made with.
+func (me *AgileApi) SessionToken() string {
+	return me.token()
+}
@@ -0,0 +1,111 @@
+package agileapi
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestReAuthReachesEveryCopy(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	copied := api.WithContext(context.Background())
+
+	stub.Expire()
+	err := copied.SetMTime("/a", "1700000000")
+	if err != nil {
+		t.Fatalf("SetMTime through a copy after expiry: %s", err)
+	}
+	err = api.SetMTime("/a", "1700000000")
+	if err != nil {
+		t.Fatalf("SetMTime on the original after expiry: %s", err)
+	}
+	if stub.Logins != 2 {
+		t.Errorf("logged in %d times, want 2", stub.Logins)
+	}
+	if api.SessionToken() != "token-2" || copied.SessionToken() != "token-2" {
+		t.Errorf("session tokens %q and %q, want token-2", api.SessionToken(), copied.SessionToken())
+	}
+	for _, call := range stub.Calls() {
+		if call.Method == "setMTime" && call.Token != "token-2" {
+			t.Errorf("setMTime sent with %q", call.Token)
+		}
+	}
+}
+
+func TestConcurrentReAuthLogsInOnce(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+
+	stub.Expire()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- api.WithContext(context.Background()).SetMTime("/a", "1700000000")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("SetMTime after expiry: %s", err)
+		}
+	}
+	if stub.Logins != 2 {
+		t.Errorf("logged in %d times, want 2", stub.Logins)
+	}
+}
+
+func TestFailedReAuthKeepsToken(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+
+	stub.Lock()
+	stub.FailLogins = true
+	stub.Unlock()
+	api.ReAuth()
+	if api.SessionToken() != "token-1" {
+		t.Errorf("session token %q after a failed login, want token-1", api.SessionToken())
+	}
+	cached, err := os.ReadFile(api.TokenCache)
+	if err != nil || string(cached) != "token-1" {
+		t.Errorf("token cache has %q, %v, want token-1", cached, err)
+	}
+}
+
+func TestSessionWithoutConstructor(t *testing.T) {
+	stub := newStubAgile(t)
+	seed := stub.api()
+	api := &AgileApi{
+		Token:      seed.SessionToken(),
+		Url:        seed.Url,
+		Username:   "user",
+		Password:   "secret",
+		TokenCache: seed.TokenCache,
+		HTTPClient: seed.HTTPClient,
+	}
+
+	stub.Expire()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := api.WithContext(context.Background()).SetMTime("/a", "1700000000")
+			if err != nil {
+				t.Errorf("SetMTime after expiry: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if api.SessionToken() != "token-2" {
+		t.Errorf("session token %q, want token-2", api.SessionToken())
+	}
+	if api.Token != "token-1" {
+		t.Errorf("Token changed to %q, it is only the starting token", api.Token)
+	}
+}
@@ -0,0 +1,190 @@
+// Package agilesftp is an SFTP server whose files live in Agile.  Each user
+// authenticates with a public key and is chrooted to their own Agile
+// directory.  Uploads stream straight into UploadFileStream and downloads
+// are read from egress.
+package agilesftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+
+	"github.com/Harnish/agileapi"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// User is one entry of the users config.
+type User struct {
+	Name string `json:"name"`
+	// Root is the Agile directory the user is chrooted to.
+	Root string `json:"root"`
+	// AuthorizedKeys are public keys in authorized_keys format.
+	AuthorizedKeys []string `json:"authorized_keys"`
+	ReadOnly       bool     `json:"read_only"`
+
+	keys []ssh.PublicKey
+}
+
+type UsersConfig struct {
+	Users []*User `json:"users"`
+}
+
+// LoadUsers reads a JSON users config such as
+//
+//	{"users": [{"name": "partner", "root": "/incoming/partner", "authorized_keys": ["ssh-ed25519 AAAA..."]}]}
+func LoadUsers(filename string) (map[string]*User, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config UsersConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("agilesftp: bad users config %s: %s", filename, err)
+	}
+	users := map[string]*User{}
+	for _, user := range config.Users {
+		if user.Name == "" || user.Root == "" {
+			return nil, fmt.Errorf("agilesftp: users need a name and a root")
+		}
+		for _, line := range user.AuthorizedKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("agilesftp: bad key for %s: %s", user.Name, err)
+			}
+			user.keys = append(user.keys, key)
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
+
+type Server struct {
+	Files *agileapi.AgileFiles
+	Users map[string]*User
+	// HostKeys identify the server to clients.
+	HostKeys []ssh.Signer
+	// Logger defaults to the AgileApi logger.
+	Logger *slog.Logger
+}
+
+func New(af *agileapi.AgileFiles, users map[string]*User, hostkeys ...ssh.Signer) *Server {
+	return &Server{
+		Files:    af,
+		Users:    users,
+		HostKeys: hostkeys,
+		Logger:   af.AgileApi.Logger,
+	}
+}
+
+// LoadHostKey reads a PEM encoded private key, e.g. one made by ssh-keygen.
+func LoadHostKey(filename string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func (me *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return me.Serve(listener)
+}
+
+func (me *Server) Serve(listener net.Listener) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: me.checkKey,
+	}
+	for _, key := range me.HostKeys {
+		config.AddHostKey(key)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go me.handleConn(conn, config)
+	}
+}
+
+func (me *Server) checkKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, ok := me.Users[meta.User()]
+	if ok {
+		marshaled := string(key.Marshal())
+		for _, allowed := range user.keys {
+			if string(allowed.Marshal()) == marshaled {
+				return &ssh.Permissions{Extensions: map[string]string{"user": user.Name}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("agilesftp: unknown key for %s", meta.User())
+}
+
+func (me *Server) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		me.logger().Debug("ssh handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	defer sconn.Close()
+	user := me.Users[sconn.Permissions.Extensions["user"]]
+	me.logger().Info("sftp login", "user", user.Name, "remote", sconn.RemoteAddr().String())
+	go ssh.DiscardRequests(requests)
+
+	for newchannel := range channels {
+		if newchannel.ChannelType() != "session" {
+			newchannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, chanrequests, err := newchannel.Accept()
+		if err != nil {
+			me.logger().Debug("accept channel failed", "user", user.Name, "error", err)
+			continue
+		}
+		go me.handleSession(user, channel, chanrequests)
+	}
+}
+
+// handleSession only offers the sftp subsystem, no shells or exec.
+func (me *Server) handleSession(user *User, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		server := sftp.NewRequestServer(channel, me.handlers(user))
+		err := server.Serve()
+		if err != nil && err != io.EOF {
+			me.logger().Warn("sftp session ended", "user", user.Name, "error", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+func (me *Server) handlers(user *User) sftp.Handlers {
+	h := &handler{files: me.Files, user: user}
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+func (me *Server) logger() *slog.Logger {
+	if me.Logger != nil {
+		return me.Logger
+	}
+	return slog.Default()
+}
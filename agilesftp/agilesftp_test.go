@@ -0,0 +1,227 @@
+package agilesftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Harnish/agileapi"
+	"github.com/Harnish/agileapi/internal/agilestub"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// stubServer serves SFTP for users on the stub, returning its address and
+// a key each user can log in with.
+func stubServer(t *testing.T, users ...*User) (string, ssh.Signer, *agilestub.Server) {
+	stub := agilestub.New(t)
+	api, err := agileapi.NewWithConfig(agileapi.Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        stub.URL + "/jsonrpc",
+		TokenCache: filepath.Join(t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: stub.Transport()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	af := &agileapi.AgileFiles{AgileApi: api, EgressURL: stub.URL + "/egress"}
+	userkey := newSigner(t)
+	byname := map[string]*User{}
+	for _, user := range users {
+		user.keys = []ssh.PublicKey{userkey.PublicKey()}
+		byname[user.Name] = user
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go New(af, byname, newSigner(t)).Serve(listener)
+	return listener.Addr().String(), userkey, stub
+}
+
+func dial(t *testing.T, addr, name string, key ssh.Signer) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, nil
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	addr, key, stub := stubServer(t, &User{Name: "partner", Root: "/incoming/partner"})
+	client, err := dial(t, addr, "partner", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("a,b\n1,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := stub.Contents("/incoming/partner/report.csv"); string(data) != "a,b\n1,2\n" {
+		t.Errorf("stored %q", data)
+	}
+
+	f, err = client.Open("/report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "a,b\n1,2\n" {
+		t.Errorf("read %q, %v", data, err)
+	}
+}
+
+func TestChroot(t *testing.T) {
+	addr, key, stub := stubServer(t, &User{Name: "partner", Root: "/incoming/partner"})
+	stub.Put("/incoming/partner/mine", []byte("mine"))
+	stub.Put("/incoming/other/theirs", []byte("theirs"))
+	stub.Put("/secret", []byte("secret"))
+	client, err := dial(t, addr, "partner", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/", "..", "../..", "/../other"} {
+		infos, err := client.ReadDir(dir)
+		if dir == "/../other" {
+			// That is /other under the root, which isn't there.
+			if err == nil {
+				t.Errorf("listed %s outside the root", dir)
+			}
+			continue
+		}
+		if err != nil || len(infos) != 1 || infos[0].Name() != "mine" {
+			t.Errorf("ReadDir(%s): %v, %v", dir, infos, err)
+		}
+	}
+	if _, err = client.Open("/../../secret"); err == nil {
+		t.Error("opened a file outside the root")
+	}
+	f, err := client.Create("/../other/planted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+	if _, ok := stub.Contents("/incoming/other/planted"); ok {
+		t.Error("wrote outside the root")
+	}
+	if _, ok := stub.Contents("/incoming/partner/other/planted"); !ok {
+		t.Errorf("stored %q, want the write under the root", stub.Paths())
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	addr, key, stub := stubServer(t, &User{Name: "reader", Root: "/out", ReadOnly: true})
+	stub.Put("/out/f", []byte("f"))
+	client, err := dial(t, addr, "reader", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := client.Create("/new"); err == nil {
+		f.Write([]byte("x"))
+		if err = f.Close(); err == nil {
+			t.Error("read only user uploaded")
+		}
+	}
+	for name, op := range map[string]func() error{
+		"remove": func() error { return client.Remove("/f") },
+		"rename": func() error { return client.Rename("/f", "/g") },
+		"mkdir":  func() error { return client.Mkdir("/d") },
+	} {
+		if err := op(); err == nil {
+			t.Errorf("read only user could %s", name)
+		}
+	}
+	if paths := stub.Paths(); len(paths) != 1 || paths[0] != "/out/f" {
+		t.Errorf("stored %q, want only /out/f", paths)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	addr, _, _ := stubServer(t, &User{Name: "partner", Root: "/in"})
+	if _, err := dial(t, addr, "partner", newSigner(t)); err == nil {
+		t.Error("logged in with a key that isn't authorized")
+	}
+}
+
+func TestListHidesAtomicTemps(t *testing.T) {
+	addr, key, stub := stubServer(t, &User{Name: "partner", Root: "/in"})
+	stub.Put("/in/f", []byte("f"))
+	stub.Put("/in/.agile-tmp-1-g", []byte("g"))
+	client, err := dial(t, addr, "partner", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := client.ReadDir("/")
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	if err != nil || len(names) != 1 || names[0] != "f" {
+		t.Errorf("listed %q, %v, want [f]", names, err)
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	key := newSigner(t).PublicKey()
+	config := `{"users": [{"name": "partner", "root": "/in", "read_only": true, "authorized_keys": ["` +
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + `"]}]}`
+	filename := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(filename, []byte(config), 0600)
+	users, err := LoadUsers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := users["partner"]
+	if user == nil || user.Root != "/in" || !user.ReadOnly || len(user.keys) != 1 {
+		t.Fatalf("loaded %+v", user)
+	}
+
+	os.WriteFile(filename, []byte(`{"users": [{"name": "partner"}]}`), 0600)
+	if _, err = LoadUsers(filename); err == nil {
+		t.Error("loaded a user without a root")
+	}
+	os.WriteFile(filename, []byte(`{"users": [{"name": "p", "root": "/in", "authorized_keys": ["not a key"]}]}`), 0600)
+	if _, err = LoadUsers(filename); err == nil {
+		t.Error("loaded a bad key")
+	}
+}
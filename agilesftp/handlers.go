@@ -0,0 +1,266 @@
+package agilesftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/Harnish/agileapi"
+	"github.com/pkg/sftp"
+)
+
+// maxPending bounds how much out of order write data is held while waiting
+// for the gap before it to arrive.
+const maxPending = 64 * 1024 * 1024
+
+// handler serves one user's session, chrooted to user.Root.
+type handler struct {
+	files *agileapi.AgileFiles
+	user  *User
+}
+
+// agilePath maps a path the client sees onto the user's Agile directory.
+func (me *handler) agilePath(clientpath string) string {
+	return path.Join(me.user.Root, path.Clean("/"+clientpath))
+}
+
+func (me *handler) stat(mypath string) (agileapi.Filestruct, error) {
+	if mypath == path.Clean(me.user.Root) {
+		return agileapi.Filestruct{Filename: "/", Path: mypath, IsDir: true}, nil
+	}
+	info, err := me.files.Stat(mypath)
+	if err != nil {
+		return agileapi.Filestruct{}, err
+	}
+	return info.Sys().(agileapi.Filestruct), nil
+}
+
+func (me *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	mypath := me.agilePath(r.Filepath)
+	info, err := me.stat(mypath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	file, err := me.files.GetFile(mypath)
+	if err != nil {
+		return nil, err
+	}
+	return &egressReader{file: file, size: int64(info.Size)}, nil
+}
+
+func (me *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if me.user.ReadOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	dir, filename := path.Split(me.agilePath(r.Filepath))
+	pr, pw := io.Pipe()
+	upload := &uploadWriter{
+		pw:      pw,
+		pending: map[int64][]byte{},
+		done:    make(chan error, 1),
+	}
+	go func() {
+		err := me.files.AgileApi.UploadFileStream(dir, filename, pr)
+		pr.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+func (me *handler) Filecmd(r *sftp.Request) error {
+	if me.user.ReadOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	mypath := me.agilePath(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		if r.AttrFlags().Acmodtime {
+			mtime := r.Attributes().Mtime
+			return me.files.AgileApi.SetMTime(mypath, strconv.FormatUint(uint64(mtime), 10))
+		}
+		return nil
+	case "Rename", "PosixRename":
+		return me.files.AgileApi.RenameFile(mypath, me.agilePath(r.Target))
+	case "Rmdir":
+		return me.files.AgileApi.RmDir(mypath)
+	case "Remove":
+		return me.files.AgileApi.RmFile(mypath)
+	case "Mkdir":
+		return me.files.AgileApi.MkDir2(mypath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (me *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	mypath := me.agilePath(r.Filepath)
+	switch r.Method {
+	case "List":
+		listing, err := me.files.List(mypath)
+		if err != nil {
+			return nil, err
+		}
+		var output listerAt
+		for _, f := range listing {
+			if !f.IsDir && agileapi.IsAtomicTemp(f.Filename) {
+				continue
+			}
+			output = append(output, f.FileInfo())
+		}
+		return output, nil
+	case "Stat":
+		info, err := me.stat(mypath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info.FileInfo()}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (me listerAt) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(me)) {
+		return 0, io.EOF
+	}
+	n := copy(out, me[offset:])
+	if n+int(offset) >= len(me) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// egressReader serves ReadAt from one egress request, only re-opening it
+// when the client jumps to a different offset.
+type egressReader struct {
+	file   *agileapi.File
+	size   int64
+	body   io.ReadCloser
+	offset int64
+	mu     sync.Mutex
+}
+
+func (me *egressReader) ReadAt(p []byte, off int64) (int, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if off >= me.size {
+		return 0, io.EOF
+	}
+	if me.body == nil || off != me.offset {
+		if me.body != nil {
+			me.body.Close()
+		}
+		body, err := me.file.NewRangeReader(off, -1)
+		if err != nil {
+			return 0, err
+		}
+		me.body = body
+		me.offset = off
+	}
+	n, err := io.ReadFull(me.body, p)
+	me.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (me *egressReader) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.body != nil {
+		return me.body.Close()
+	}
+	return nil
+}
+
+// uploadWriter turns WriteAt calls into a stream for UploadFileStream.
+// Clients may pipeline writes, so chunks that arrive ahead of the stream
+// are held until the gap before them is filled.  A failed write or a
+// client that goes away aborts the upload on Close instead of saving what
+// arrived.
+type uploadWriter struct {
+	pw      *io.PipeWriter
+	next    int64
+	pending map[int64][]byte
+	held    int
+	done    chan error
+	err     error
+	mu      sync.Mutex
+}
+
+var _ sftp.TransferError = (*uploadWriter)(nil)
+
+func (me *uploadWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	defer func() {
+		if err != nil && me.err == nil {
+			me.err = err
+		}
+	}()
+	if off != me.next {
+		if off < me.next {
+			return 0, fmt.Errorf("agilesftp: uploads can not rewrite offset %d", off)
+		}
+		if me.held+len(p) > maxPending {
+			return 0, fmt.Errorf("agilesftp: too much out of order data")
+		}
+		me.pending[off] = append([]byte(nil), p...)
+		me.held += len(p)
+		return len(p), nil
+	}
+	_, err = me.pw.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	me.next += int64(len(p))
+	for {
+		chunk, ok := me.pending[me.next]
+		if !ok {
+			break
+		}
+		delete(me.pending, me.next)
+		me.held -= len(chunk)
+		_, err = me.pw.Write(chunk)
+		if err != nil {
+			return 0, err
+		}
+		me.next += int64(len(chunk))
+	}
+	return len(p), nil
+}
+
+// TransferError is told why the server stopped with the file still open.
+func (me *uploadWriter) TransferError(err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.err == nil {
+		me.err = err
+	}
+}
+
+func (me *uploadWriter) Close() error {
+	me.mu.Lock()
+	err := me.err
+	if err == nil && len(me.pending) > 0 {
+		err = fmt.Errorf("agilesftp: upload has gaps")
+	}
+	if err != nil {
+		me.pw.CloseWithError(err)
+	} else {
+		me.pw.Close()
+	}
+	me.mu.Unlock()
+	uerr := <-me.done
+	if err != nil {
+		return err
+	}
+	return uerr
+}
@@ -0,0 +1,132 @@
+package agileapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrURLExpired   = errors.New("agileapi: signed url has expired")
+	ErrURLSignature = errors.New("agileapi: signed url has a bad signature")
+	ErrURLScope     = errors.New("agileapi: signed url is outside its scope")
+)
+
+// URLSigner makes expiring egress urls in the MediaVault style: the expiry
+// and an HMAC-SHA256 of the path or prefix, expiry and optionally the
+// client's IP are added as query parameters e and h.  Any other query
+// parameters are not signed.
+type URLSigner struct {
+	Secret []byte
+	// Prefix, when set, makes one signature good for every path under it
+	// instead of just the path signed.  It covers whole path segments, so
+	// /public covers /public/x but not /public-internal/x.
+	Prefix string
+	// BindIP makes SignedURLForIP urls only work from that IP.
+	BindIP bool
+}
+
+// Sign adds an expiry ttl from now and a signature to rawurl.  clientip is
+// only used when BindIP is set.
+func (me *URLSigner) Sign(rawurl string, ttl time.Duration, clientip string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	scope := "path\n" + u.Path
+	query := u.Query()
+	if me.Prefix != "" {
+		if !underPrefix(u.Path, me.Prefix) {
+			return "", fmt.Errorf("agileapi: %s is not under %s", u.Path, me.Prefix)
+		}
+		scope = "prefix\n" + me.Prefix
+		query.Set("p", me.Prefix)
+	}
+	if !me.BindIP {
+		clientip = ""
+	} else if clientip == "" {
+		return "", fmt.Errorf("agileapi: signer binds to an IP but none was given")
+	} else {
+		query.Set("ip", "1")
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query.Set("e", expires)
+	query.Set("h", urlSignature(me.Secret, scope, expires, clientip))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// urlSignature signs scope, which starts with whether it is a whole path or
+// a prefix so that one can't be passed off as the other.
+func urlSignature(secret []byte, scope, expires, clientip string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(scope + "\n" + expires + "\n" + clientip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignedURL checks a url made by URLSigner.Sign, as it would be at an
+// edge: clientip is the address the request came from and now the time it
+// arrived.
+func VerifySignedURL(secret []byte, rawurl, clientip string, now time.Time) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	expires := query.Get("e")
+	signature := query.Get("h")
+	if expires == "" || signature == "" {
+		return ErrURLSignature
+	}
+	scope := "path\n" + u.Path
+	if prefix := query.Get("p"); prefix != "" {
+		if !underPrefix(u.Path, prefix) || strings.Contains(u.Path[len(prefix):], "..") {
+			return ErrURLScope
+		}
+		scope = "prefix\n" + prefix
+	}
+	if query.Get("ip") == "" {
+		clientip = ""
+	}
+	expected := urlSignature(secret, scope, expires, clientip)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrURLSignature
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrURLSignature
+	}
+	if now.Unix() > unix {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+// underPrefix is whether path is prefix or below it, a whole segment at a
+// time.
+func underPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// SignedURL is the file's egress url signed by the AgileFiles Signer to
+// expire after ttl.
+func (me *File) SignedURL(ttl time.Duration) (string, error) {
+	return me.SignedURLForIP(ttl, "")
+}
+
+// SignedURLForIP is SignedURL bound to clientip when the Signer has BindIP.
+func (me *File) SignedURLForIP(ttl time.Duration, clientip string) (string, error) {
+	if me.af.Signer == nil {
+		return "", fmt.Errorf("agileapi: no url signer configured")
+	}
+	return me.af.Signer.Sign(me.Url, ttl, clientip)
+}
@@ -0,0 +1,51 @@
+package agileapi
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	path := &URLSigner{Secret: secret}
+	prefix := &URLSigner{Secret: secret, Prefix: "/public"}
+
+	signed, err := path.Sign("https://egress.example.com/media/a.mp4", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySignedURL(secret, signed, "", now); err != nil {
+		t.Errorf("path url: %v", err)
+	}
+	if err = VerifySignedURL(secret, signed, "", now.Add(2*time.Hour)); err != ErrURLExpired {
+		t.Errorf("expired path url: %v", err)
+	}
+
+	// A path signature passed off as a prefix.
+	u, _ := url.Parse(signed)
+	u.Path = "/media/a.mp4.private/b.mp4"
+	query := u.Query()
+	query.Set("p", "/media/a.mp4")
+	u.RawQuery = query.Encode()
+	if err = VerifySignedURL(secret, u.String(), "", now); err == nil {
+		t.Error("path signature verified as a prefix")
+	}
+
+	signed, err = prefix.Sign("https://egress.example.com/public/x/y.mp4", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySignedURL(secret, signed, "", now); err != nil {
+		t.Errorf("prefix url: %v", err)
+	}
+	u, _ = url.Parse(signed)
+	u.Path = "/public-internal/y.mp4"
+	if err = VerifySignedURL(secret, u.String(), "", now); err != ErrURLScope {
+		t.Errorf("prefix matched part of a segment: %v", err)
+	}
+	if _, err = prefix.Sign("https://egress.example.com/public-internal/y.mp4", time.Hour, ""); err == nil {
+		t.Error("signed a path that only shares the prefix's characters")
+	}
+}
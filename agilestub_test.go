@@ -0,0 +1,39 @@
+package agileapi
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/Harnish/agileapi/internal/agilestub"
+)
+
+// stubAgile is the shared Agile stub with helpers for this package.
+type stubAgile struct {
+	*agilestub.Server
+	t *testing.T
+}
+
+func newStubAgile(t *testing.T) *stubAgile {
+	return &stubAgile{Server: agilestub.New(t), t: t}
+}
+
+// api logs in to the stub with a fresh token cache.
+func (me *stubAgile) api() *AgileApi {
+	api, err := NewWithConfig(Config{
+		Username:   "user",
+		Password:   "secret",
+		Url:        me.URL + "/jsonrpc",
+		TokenCache: filepath.Join(me.t.TempDir(), "token"),
+		HTTPClient: &http.Client{Transport: me.Transport()},
+	})
+	if err != nil {
+		me.t.Fatal(err)
+	}
+	return api
+}
+
+// agileFiles is an AgileFiles on api with the stub as its egress host.
+func (me *stubAgile) agileFiles(api *AgileApi) *AgileFiles {
+	return &AgileFiles{AgileApi: api, EgressURL: me.URL + "/egress"}
+}
@@ -0,0 +1,197 @@
+package agileapi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+// WalkFunc is called by Walk for every directory and file under root.
+// Returning fs.SkipDir from a directory skips its contents.
+type WalkFunc func(mypath string, file Filestruct, err error) error
+
+// Walk visits the tree under root on b depth first, in the order List
+// returns entries.
+func Walk(b Backend, root string, fn WalkFunc) error {
+	files, err := b.List(root)
+	if err != nil {
+		return fn(root, Filestruct{Path: root, IsDir: true}, err)
+	}
+	for _, file := range files {
+		mypath := path.Join(root, file.Filename)
+		err = fn(mypath, file, nil)
+		if file.IsDir {
+			if err == fs.SkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = Walk(b, mypath, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find returns every file under root whose name matches pattern, using
+// path.Match syntax.
+func Find(b Backend, root, pattern string) ([]Filestruct, error) {
+	var output []Filestruct
+	err := Walk(b, root, func(mypath string, file Filestruct, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir {
+			return nil
+		}
+		matched, err := path.Match(pattern, file.Filename)
+		if err != nil {
+			return err
+		}
+		if matched {
+			file.Path = mypath
+			output = append(output, file)
+		}
+		return nil
+	})
+	return output, err
+}
+
+type SyncOptions struct {
+	// Delete removes files under the destination that are not in the source.
+	Delete bool
+	// DryRun reports what would change without touching the destination.
+	DryRun bool
+	// Atomic writes each file to a temp name and renames it into place.
+	Atomic bool
+}
+
+type SyncResult struct {
+	Copied  []string
+	Skipped []string
+	Deleted []string
+	Bytes   uint64
+}
+
+// Sync makes dstroot on dst match srcroot on src.  Files are copied when
+// they are missing, differ in size, or differ in checksum (or in mtime when
+// either side has no checksum).  Copied files get the source mtime.
+func Sync(src Backend, srcroot string, dst Backend, dstroot string, opts *SyncOptions) (*SyncResult, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	result := &SyncResult{}
+	seen := map[string]bool{}
+	err := Walk(src, srcroot, func(mypath string, file Filestruct, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := mypath[len(path.Clean(srcroot)):]
+		target := path.Join(dstroot, rel)
+		seen[target] = true
+		if file.IsDir {
+			return nil
+		}
+		existing, err := dst.Stat(target)
+		if err == nil && syncSame(file, existing) {
+			result.Skipped = append(result.Skipped, target)
+			return nil
+		}
+		result.Copied = append(result.Copied, target)
+		result.Bytes += file.Size
+		if opts.DryRun {
+			return nil
+		}
+		return syncCopy(src, mypath, dst, target, file, opts.Atomic)
+	})
+	if err != nil {
+		return result, err
+	}
+	if !opts.Delete {
+		return result, nil
+	}
+	// Every listing has to succeed before anything is deleted, a failed one
+	// would otherwise look like an empty directory.
+	var extra []Filestruct
+	err = Walk(dst, dstroot, func(mypath string, file Filestruct, err error) error {
+		if err != nil && mypath == path.Clean(dstroot) && errors.Is(err, fs.ErrNotExist) {
+			// A destination that isn't there has nothing to delete.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !seen[mypath] {
+			file.Path = mypath
+			extra = append(extra, file)
+			if file.IsDir {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, file := range extra {
+		result.Deleted = append(result.Deleted, file.Path)
+		if opts.DryRun {
+			continue
+		}
+		err = removeAll(dst, file)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func syncCopy(src Backend, srcpath string, dst Backend, dstpath string, file Filestruct, atomic bool) error {
+	data, err := src.Open(srcpath)
+	if err != nil {
+		return fmt.Errorf("Sync - open %s Error: %s", srcpath, err)
+	}
+	defer data.Close()
+	if atomic {
+		err = putAtomic(dst, dstpath, data)
+	} else {
+		err = dst.Put(dstpath, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Sync - put %s Error: %s", dstpath, err)
+	}
+	return dst.SetMtime(dstpath, file.Mtime)
+}
+
+func syncSame(file Filestruct, existing fs.FileInfo) bool {
+	if existing.IsDir() || uint64(existing.Size()) != file.Size {
+		return false
+	}
+	other, ok := existing.Sys().(Filestruct)
+	if ok && file.Sha256 != "" && other.Sha256 != "" {
+		return file.Sha256 == other.Sha256
+	}
+	return existing.ModTime().Unix() == file.Mtime.Unix()
+}
+
+// removeAll deletes file and, for a directory, everything under it.
+func removeAll(b Backend, file Filestruct) error {
+	if file.IsDir {
+		files, err := b.List(file.Path)
+		if err != nil {
+			return err
+		}
+		for _, child := range files {
+			child.Path = path.Join(file.Path, child.Filename)
+			err = removeAll(b, child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return b.Delete(file.Path)
+}
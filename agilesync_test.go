@@ -0,0 +1,69 @@
+package agileapi
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestListReturnsListingErrors(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	stub.Put("/dir/a.txt", []byte("a"))
+	stub.Put("/dir/sub/b.txt", []byte("b"))
+
+	files, err := af.List("/dir")
+	if err != nil || len(files) != 2 || !files[0].IsDir || files[1].Filename != "a.txt" {
+		t.Fatalf("List: %+v, %v", files, err)
+	}
+	_, err = af.List("/missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List of a missing directory: %v", err)
+	}
+	stub.Lock()
+	stub.ListCodes["/dir"] = -5
+	stub.Unlock()
+	_, err = af.List("/dir")
+	if err == nil {
+		t.Error("List hid a failed listing")
+	}
+}
+
+func TestSyncDeleteStopsOnFailedListing(t *testing.T) {
+	stub := newStubAgile(t)
+	af := stub.agileFiles(stub.api())
+	stub.Put("/src/a.txt", []byte("a"))
+	stub.Lock()
+	stub.ListCodes["/src"] = -5
+	stub.Unlock()
+	dst := NewMemBackend()
+	dst.Put("/dst/keep.txt", bytes.NewReader([]byte("keep")))
+
+	// A source listing that fails must not look like an empty source.
+	_, err := Sync(af, "/src", dst, "/dst", &SyncOptions{Delete: true})
+	if err == nil {
+		t.Error("Sync went on after the source listing failed")
+	}
+	if _, err = dst.Stat("/dst/keep.txt"); err != nil {
+		t.Errorf("destination file deleted: %v", err)
+	}
+
+	// Nor one on the destination.
+	src := NewMemBackend()
+	src.Put("/src/a.txt", bytes.NewReader([]byte("a")))
+	stub.Put("/dst/keep.txt", []byte("keep"))
+	stub.Lock()
+	stub.ListCodes["/dst"] = -5
+	stub.Unlock()
+	result, err := Sync(src, "/src", af, "/dst", &SyncOptions{Delete: true})
+	if err == nil || len(result.Deleted) != 0 {
+		t.Errorf("Sync with a failed destination listing: %+v, %v", result, err)
+	}
+
+	// A destination that doesn't exist yet is empty, not an error.
+	result, err = Sync(src, "/src", NewMemBackend(), "/new", &SyncOptions{Delete: true, DryRun: true})
+	if err != nil || len(result.Copied) != 1 {
+		t.Errorf("Sync to a new destination: %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,113 @@
+package agileapi
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Harnish/agileapi"
+
+// WithContext returns a copy of me whose calls run under ctx.  Spans are
+// parented on any span in ctx and requests are cancelled with it.  The copy
+// shares me's session, so a token refreshed through either is used by both.
+func (me *AgileApi) WithContext(ctx context.Context) *AgileApi {
+	if !me.base().seeded {
+		// Make the session before copying, rather than racing another
+		// copy's first call to make it.
+		me.sharedSession()
+	}
+	c := *me
+	c.ctx = ctx
+	c.root = me.base()
+	c.Token = ""
+	return &c
+}
+
+// WithContext returns a copy of me whose calls run under ctx.
+func (me *AgileFiles) WithContext(ctx context.Context) *AgileFiles {
+	c := *me
+	c.AgileApi = me.AgileApi.WithContext(ctx)
+	return &c
+}
+
+func (me *AgileApi) context() context.Context {
+	if me.ctx != nil {
+		return me.ctx
+	}
+	return context.Background()
+}
+
+// base is the AgileApi that copies made by WithContext share a token with.
+func (me *AgileApi) base() *AgileApi {
+	if me.root != nil {
+		return me.root
+	}
+	return me
+}
+
+func (me *AgileApi) tracer() trace.Tracer {
+	if me.TracerProvider != nil {
+		return me.TracerProvider.Tracer(tracerName)
+	}
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// trace starts a span for a public method.  It returns a copy of me running
+// under the span, so calls made through it become children, and a func
+// that ends the span with the method's error.
+func (me *AgileApi) trace(name string, attrs ...attribute.KeyValue) (*AgileApi, func(*error)) {
+	ctx, span := me.tracer().Start(me.context(), "AgileApi."+name, trace.WithAttributes(attrs...))
+	c := me.WithContext(ctx)
+	return c, func(errp *error) {
+		var err error
+		if errp != nil {
+			err = *errp
+		}
+		endSpan(span, err)
+	}
+}
+
+func (me *AgileFiles) trace(name string, attrs ...attribute.KeyValue) (*AgileFiles, func(*error)) {
+	api := me.AgileApi
+	ctx, span := api.tracer().Start(api.context(), "AgileFiles."+name, trace.WithAttributes(attrs...))
+	c := me.WithContext(ctx)
+	return c, func(errp *error) {
+		var err error
+		if errp != nil {
+			err = *errp
+		}
+		endSpan(span, err)
+	}
+}
+
+// annotate adds attributes to the span me is running under.
+func (me *AgileApi) annotate(attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(me.context()).SetAttributes(attrs...)
+}
+
+// roundTrip starts the client span for one HTTP request and sends the
+// trace context along with it.
+func roundTrip(ctx context.Context, tracer trace.Tracer, name string, req *http.Request, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func pathAttr(path string) attribute.KeyValue {
+	return attribute.String("agile.path", path)
+}
@@ -0,0 +1,223 @@
+package agileapi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How UploadOptions picks the content type.
+const (
+	// ContentTypeAuto leaves it to Agile to detect.
+	ContentTypeAuto = ""
+	// ContentTypeExtension looks the file's extension up with mime.TypeByExtension.
+	ContentTypeExtension = "extension"
+	// ContentTypeSniff uses http.DetectContentType on the first 512 bytes.
+	ContentTypeSniff = "sniff"
+)
+
+// sniffLen is how much http.DetectContentType looks at.
+const sniffLen = 512
+
+// UploadOptions changes how a file is uploaded.  A nil *UploadOptions is
+// the same as the zero value.
+type UploadOptions struct {
+	// ContentTypeMode is ContentTypeAuto, ContentTypeExtension or
+	// ContentTypeSniff.
+	ContentTypeMode string
+	// ContentType, when set, is sent as is and ContentTypeMode is ignored.
+	ContentType string
+	// ContentDetect is sent as X-Agile-Content-Detect when no content type
+	// is.  Defaults to "auto".
+	ContentDetect string
+	// NoRecursive fails the upload when the directory doesn't exist rather
+	// than creating it.
+	NoRecursive bool
+	// ExposeEgress is sent as X-Agile-Expose-Egress.  Defaults to "COMPLETE".
+	ExposeEgress string
+	// Checksum is the expected sha256 of the file, sent as X-Agile-Checksum
+	// for Agile to check.
+	Checksum string
+	// FailIfExists stats the path first and fails with an error matching
+	// fs.ErrExist if something is there.
+	FailIfExists bool
+	// Mtime, when set, is applied once the upload has finished.
+	Mtime time.Time
+	// Headers are sent too, replacing any of the above with the same name.
+	Headers map[string]string
+	// Atomic uploads to a hidden temp name in the same directory and renames
+	// it into place once its sha256 checks out, so readers never see a
+	// partial file.  Only AgileFiles uploads honour it.
+	Atomic bool
+	// Verify compares the sha256 of what was sent with what Agile stored
+	// afterwards, uploading again on a mismatch if the reader is an
+	// io.Seeker.  Only AgileFiles uploads honour it.
+	Verify bool
+	// VerifyRetries is how many times to upload again.  Defaults to
+	// DefaultVerifyRetries.
+	VerifyRetries int
+
+	// Compression is CompressionGzip or CompressionZstd to compress the
+	// file on the way up.  It's recorded as the content type unless
+	// CompressionSuffix is set, which adds ".gz" or ".zst" to the name
+	// instead.  File reads decompress either way when AgileFiles
+	// Decompress is set.
+	Compression       string
+	CompressionSuffix bool
+
+	// prepared is set once the data has been compressed and encrypted.
+	prepared bool
+}
+
+func (me *UploadOptions) isPrepared() bool {
+	return me != nil && me.prepared
+}
+
+// storedName is filename as it will be stored.
+func (me *UploadOptions) storedName(filename string) string {
+	if me == nil || !me.CompressionSuffix {
+		return filename
+	}
+	suffix := compressionSuffixes[me.Compression]
+	if suffix == "" || strings.HasSuffix(filename, suffix) {
+		return filename
+	}
+	return filename + suffix
+}
+
+// prepareUpload turns data into what is stored: compressed, then
+// encrypted.  AgileFiles uploads hash what is sent so they do this before
+// the hash, and the content type has to be worked out from the original
+// data first.  The options returned carry the content type.
+func (me *AgileApi) prepareUpload(filename string, data io.Reader, opts *UploadOptions) (io.Reader, *UploadOptions, error) {
+	if opts.isPrepared() {
+		return data, opts, nil
+	}
+	contenttype, data, err := opts.contentType(filename, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var prepared UploadOptions
+	if opts != nil {
+		prepared = *opts
+	}
+	if prepared.Compression != "" {
+		data, err = compressStream(prepared.Compression, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !prepared.CompressionSuffix {
+			contenttype = compressionTypes[prepared.Compression]
+		}
+	}
+	if me.Encryption != nil {
+		data, err = encryptStream(me.Encryption, data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	prepared.ContentType = contenttype
+	prepared.ContentTypeMode = ContentTypeAuto
+	prepared.prepared = true
+	return data, &prepared, nil
+}
+
+// hashed is whether the upload has to go through
+// AgileFiles.UploadFileStreamReturnSha.
+func (me *UploadOptions) hashed() bool {
+	return me != nil && (me.Atomic || me.Verify)
+}
+
+// headers builds the X-Agile headers for an upload.
+func (me *UploadOptions) headers(token, dir, file, contenttype string) map[string]string {
+	if me == nil {
+		me = &UploadOptions{}
+	}
+	params := map[string]string{
+		"X-Agile-Authorization": token,
+		"X-Agile-Directory":     dir,
+		"X-Agile-Basename":      file,
+		"X-Agile-Expose-Egress": "COMPLETE",
+		"X-Agile-Recursive":     "true",
+	}
+	if me.ExposeEgress != "" {
+		params["X-Agile-Expose-Egress"] = me.ExposeEgress
+	}
+	if me.NoRecursive {
+		params["X-Agile-Recursive"] = "false"
+	}
+	if contenttype != "" {
+		params["X-Agile-Content-Type"] = contenttype
+		params["Content-Type"] = contenttype
+	} else if me.ContentDetect != "" {
+		params["X-Agile-Content-Detect"] = me.ContentDetect
+	} else {
+		params["X-Agile-Content-Detect"] = "auto"
+	}
+	if me.Checksum != "" {
+		params["X-Agile-Checksum"] = me.Checksum
+	}
+	for k, v := range me.Headers {
+		params[k] = v
+	}
+	return params
+}
+
+// before runs the checks that have to pass before an upload starts.
+func (me *UploadOptions) before(api *AgileApi, mypath string) error {
+	if me == nil || !me.FailIfExists {
+		return nil
+	}
+	stat, err := api.StatFile(mypath)
+	if err != nil {
+		return err
+	}
+	err = stat.Err(mypath)
+	if err == nil {
+		return &fs.PathError{Op: "upload", Path: mypath, Err: fs.ErrExist}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// after applies what has to be done once an upload has finished.
+func (me *UploadOptions) after(api *AgileApi, mypath string) error {
+	if me == nil || me.Mtime.IsZero() {
+		return nil
+	}
+	return api.SetMTime(mypath, strconv.FormatInt(me.Mtime.Unix(), 10))
+}
+
+// contentType works out the type to send for filename, returning the
+// reader to upload from in its place as sniffing consumes the start of it.
+// An empty type leaves detection to Agile.
+func (me *UploadOptions) contentType(filename string, data io.Reader) (string, io.Reader, error) {
+	if me == nil {
+		return "", data, nil
+	}
+	if me.ContentType != "" {
+		return me.ContentType, data, nil
+	}
+	switch me.ContentTypeMode {
+	case ContentTypeExtension:
+		return mime.TypeByExtension(path.Ext(filename)), data, nil
+	case ContentTypeSniff:
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(data, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", nil, err
+		}
+		head = head[:n]
+		return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), data), nil
+	}
+	return "", data, nil
+}
@@ -0,0 +1,98 @@
+package agileapi
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadWithMtimeOneSlot(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Limits = NewLimits(0, 0, 0, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		opts := &UploadOptions{Mtime: time.Unix(1700000000, 0)}
+		done <- api.UploadFileStreamWithOptions("/dir", "a.txt", strings.NewReader("hello"), opts)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload is still waiting to set the mtime")
+	}
+	var set bool
+	for _, call := range stub.Calls() {
+		set = set || call.Method == "setMTime"
+	}
+	if !set {
+		t.Error("mtime was not set")
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 600)...)
+	for _, tc := range []struct {
+		name     string
+		filename string
+		opts     *UploadOptions
+		want     string
+		detect   string
+	}{
+		{"nil options", "a.html", nil, "", "auto"},
+		{"auto", "a.html", &UploadOptions{}, "", "auto"},
+		{"detect", "a.html", &UploadOptions{ContentDetect: "extension"}, "", "extension"},
+		{"extension", "a.html", &UploadOptions{ContentTypeMode: ContentTypeExtension}, "text/html; charset=utf-8", ""},
+		{"unknown extension", "a.unknownext", &UploadOptions{ContentTypeMode: ContentTypeExtension}, "", "auto"},
+		{"sniff", "a.bin", &UploadOptions{ContentTypeMode: ContentTypeSniff}, "image/png", ""},
+		{"explicit", "a.html", &UploadOptions{ContentTypeMode: ContentTypeSniff, ContentType: "text/x-custom"}, "text/x-custom", ""},
+	} {
+		contenttype, data, err := tc.opts.contentType(tc.filename, bytes.NewReader(png))
+		if err != nil || contenttype != tc.want {
+			t.Errorf("%s: content type %q, %v, want %q", tc.name, contenttype, err, tc.want)
+		}
+		// Sniffing must not lose what it read.
+		if sent, _ := io.ReadAll(data); !bytes.Equal(sent, png) {
+			t.Errorf("%s: sends %d bytes, want %d", tc.name, len(sent), len(png))
+		}
+		headers := tc.opts.headers("token", "/", tc.filename, contenttype)
+		if headers["X-Agile-Content-Type"] != tc.want || headers["X-Agile-Content-Detect"] != tc.detect {
+			t.Errorf("%s: headers %v", tc.name, headers)
+		}
+	}
+}
+
+func TestMimeTypeSurfaces(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	af := stub.agileFiles(api)
+	err := af.PutWithOptions("/site/index.html", strings.NewReader("<html></html>"), &UploadOptions{ContentTypeMode: ContentTypeExtension})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := af.GetFile("/site/index.html")
+	if err != nil || file.MimeType != "text/html; charset=utf-8" {
+		t.Fatalf("GetFile: %+v, %v", file, err)
+	}
+	listing, err := af.List("/site")
+	if err != nil || len(listing) != 1 || listing[0].MimeType != "text/html; charset=utf-8" {
+		t.Errorf("List: %+v, %v", listing, err)
+	}
+
+	err = api.SetContentType("/site/index.html", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := af.Stat("/site/index.html")
+	if err != nil || info.Sys().(Filestruct).MimeType != "text/plain" {
+		t.Errorf("Stat after SetContentType: %+v, %v", info, err)
+	}
+	if err = api.SetContentType("/site/missing", "text/plain"); err == nil {
+		t.Error("SetContentType of a missing file succeeded")
+	}
+}
@@ -0,0 +1,161 @@
+package agileapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("agileapi: checksum mismatch")
+
+// ChecksumError is returned when what Agile stored doesn't hash to what was
+// sent.  It matches ErrChecksumMismatch with errors.Is.
+type ChecksumError struct {
+	Path   string
+	Local  string
+	Remote string
+}
+
+func (me *ChecksumError) Error() string {
+	return fmt.Sprintf("agileapi: checksum mismatch on %s, local %s Agile has %s", me.Path, me.Local, me.Remote)
+}
+
+func (me *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// DefaultVerifyRetries is how many times a verified upload is tried again
+// after a mismatch unless VerifyRetries is set.
+const DefaultVerifyRetries = 2
+
+// uploadVerified uploads, then compares the local sha256 with Agile's.  A
+// mismatch is retried when data can be rewound.
+func (me *AgileFiles) uploadVerified(dir, filename string, data io.Reader, size int64, progress bool, opts *UploadOptions) (string, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	retries := opts.VerifyRetries
+	if retries <= 0 {
+		retries = DefaultVerifyRetries
+	}
+	attemptopts := *opts
+	attemptopts.Verify = false
+	for attempt := 0; ; attempt++ {
+		sha, err := me.UploadFileStreamReturnShaWithOptions(dir, filename, data, size, progress, &attemptopts)
+		if err == nil {
+			err = me.checkSha(dir+filename, sha)
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			return sha, err
+		}
+		seeker, ok := data.(io.Seeker)
+		if !ok || attempt >= retries {
+			return "", err
+		}
+		_, serr := seeker.Seek(0, io.SeekStart)
+		if serr != nil {
+			return "", err
+		}
+		me.logger().Warn("upload checksum mismatch, retrying", "path", dir+filename, "error", err)
+		me.AgileApi.metrics().Retry("verify")
+		// The first attempt created it.
+		attemptopts.FailIfExists = false
+	}
+}
+
+// checkSha compares sha with the checksum Agile has for mypath.
+func (me *AgileFiles) checkSha(mypath, sha string) error {
+	remote, err := me.remoteSha256(mypath)
+	if err != nil {
+		return err
+	}
+	if remote != sha {
+		return &ChecksumError{Path: mypath, Local: sha, Remote: remote}
+	}
+	return nil
+}
+
+// remoteSha256 is the checksum from a stat, or from the egress
+// X-Agile-Checksum header when the stat doesn't have one.
+func (me *AgileFiles) remoteSha256(mypath string) (string, error) {
+	stat, err := me.AgileApi.StatFile(mypath)
+	if err != nil {
+		return "", err
+	}
+	err = stat.Err(mypath)
+	if err != nil {
+		return "", err
+	}
+	if stat.Checksum != "" {
+		return stat.Checksum, nil
+	}
+	req, err := http.NewRequest("HEAD", me.egressURL(mypath), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := me.egress(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Egress request failed %s Status: %d", req.URL, resp.StatusCode)
+	}
+	return resp.Header.Get("X-Agile-Checksum"), nil
+}
+
+// Verify checks that mypath on Agile has the same sha256 as localfile,
+// returning a *ChecksumError if not.  With encryption on, or Decompress
+// set, Agile's checksum is of the stored bytes, so on a mismatch mypath is
+// read back as NewReader reads it and that is compared instead.
+func (me *AgileFiles) Verify(mypath, localfile string) (err error) {
+	me, end := me.trace("Verify", pathAttr(mypath))
+	defer end(&err)
+	data, err := os.Open(localfile)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, data)
+	if err != nil {
+		return err
+	}
+	sha := hex.EncodeToString(hash.Sum(nil))
+	err = me.checkSha(mypath, sha)
+	if !errors.Is(err, ErrChecksumMismatch) || (me.AgileApi.Encryption == nil && !me.Decompress) {
+		return err
+	}
+	plain, err := me.plainSha256(mypath)
+	if err != nil {
+		return err
+	}
+	if plain != sha {
+		return &ChecksumError{Path: mypath, Local: sha, Remote: plain}
+	}
+	return nil
+}
+
+// plainSha256 hashes mypath as NewReader reads it.
+func (me *AgileFiles) plainSha256(mypath string) (string, error) {
+	file, err := me.GetFile(mypath)
+	if err != nil {
+		return "", err
+	}
+	body, err := file.open()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, body)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
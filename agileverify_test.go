@@ -0,0 +1,63 @@
+package agileapi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		encrypt     bool
+		decompress  bool
+		upload      *UploadOptions
+		nochecksums bool
+	}{
+		{name: "plain"},
+		{name: "checksum from egress", nochecksums: true},
+		{name: "encrypted", encrypt: true},
+		{name: "compressed", decompress: true, upload: &UploadOptions{Compression: CompressionGzip}},
+		{name: "compressed and encrypted", encrypt: true, decompress: true, upload: &UploadOptions{Compression: CompressionGzip}},
+	} {
+		stub := newStubAgile(t)
+		stub.Lock()
+		stub.NoChecksums = tc.nochecksums
+		stub.Unlock()
+		api := stub.api()
+		if tc.encrypt {
+			api.Encryption = testKeys()
+		}
+		af := stub.agileFiles(api)
+		af.Decompress = tc.decompress
+		_, err := af.UploadFileStreamReturnShaWithOptions("/", "f.txt", strings.NewReader("verify me"), 0, false, tc.upload)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		local := filepath.Join(t.TempDir(), "f.txt")
+		os.WriteFile(local, []byte("verify me"), 0644)
+		if err := af.Verify("/f.txt", local); err != nil {
+			t.Errorf("%s: Verify of the same content: %s", tc.name, err)
+		}
+		os.WriteFile(local, []byte("something else"), 0644)
+		err = af.Verify("/f.txt", local)
+		var mismatch *ChecksumError
+		if !errors.As(err, &mismatch) || !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: Verify of other content returned %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerifiedUpload(t *testing.T) {
+	stub := newStubAgile(t)
+	api := stub.api()
+	api.Encryption = testKeys()
+	af := stub.agileFiles(api)
+	_, err := af.UploadFileStreamReturnShaWithOptions("/", "f.txt", strings.NewReader("verify me"), 0, false, &UploadOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
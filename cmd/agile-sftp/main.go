@@ -0,0 +1,51 @@
+// Command agile-sftp serves an Agile account over SFTP.
+//
+//	AGILE_PASSWORD=secret agile-sftp -user myname -api https://myaccount.upload.llnw.net/jsonrpc -egress http://mycompany.cdn.limelight.com/ -hostkey /etc/agile-sftp/ssh_host_ed25519_key -users /etc/agile-sftp/users.json
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/Harnish/agileapi"
+	"github.com/Harnish/agileapi/agilesftp"
+)
+
+func main() {
+	user := flag.String("user", os.Getenv("AGILE_USER"), "Agile username")
+	password := flag.String("password", os.Getenv("AGILE_PASSWORD"), "Agile password")
+	api := flag.String("api", os.Getenv("AGILE_API"), "Agile JSON-RPC url")
+	egress := flag.String("egress", os.Getenv("AGILE_EGRESS"), "egress url files are read from")
+	listen := flag.String("listen", ":2022", "address to serve SFTP on")
+	hostkey := flag.String("hostkey", "", "PEM encoded ssh host key")
+	users := flag.String("users", "", "JSON users config")
+	debug := flag.Bool("debug", false, "log Agile calls")
+	flag.Parse()
+
+	if *user == "" || *password == "" || *api == "" || *egress == "" || *hostkey == "" || *users == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	key, err := agilesftp.LoadHostKey(*hostkey)
+	if err != nil {
+		log.Fatal("Can't load host key: ", err)
+	}
+	config, err := agilesftp.LoadUsers(*users)
+	if err != nil {
+		log.Fatal(err)
+	}
+	agile, err := agileapi.NewWithConfig(agileapi.Config{
+		Username: *user,
+		Password: *password,
+		Url:      *api,
+		Debug:    *debug,
+	})
+	if err != nil {
+		log.Fatal("Authentication Failed: ", err)
+	}
+
+	server := agilesftp.New(agile.NewFS(*egress), config, key)
+	log.Println("Serving SFTP on " + *listen)
+	log.Fatal(server.ListenAndServe(*listen))
+}
@@ -0,0 +1,67 @@
+// Command agile-webdav mounts an Agile account over WebDAV.
+//
+//	AGILE_PASSWORD=secret agile-webdav -user myname -api https://myaccount.upload.llnw.net/jsonrpc -egress http://mycompany.cdn.limelight.com/
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Harnish/agileapi"
+	"github.com/Harnish/agileapi/agiledav"
+	"golang.org/x/net/webdav"
+)
+
+func main() {
+	user := flag.String("user", os.Getenv("AGILE_USER"), "Agile username")
+	password := flag.String("password", os.Getenv("AGILE_PASSWORD"), "Agile password")
+	api := flag.String("api", os.Getenv("AGILE_API"), "Agile JSON-RPC url")
+	egress := flag.String("egress", os.Getenv("AGILE_EGRESS"), "egress url files are read from")
+	listen := flag.String("listen", ":8080", "address to serve WebDAV on")
+	auth := flag.String("auth", os.Getenv("WEBDAV_AUTH"), "optional user:password required from WebDAV clients")
+	debug := flag.Bool("debug", false, "log Agile calls")
+	flag.Parse()
+
+	if *user == "" || *password == "" || *api == "" || *egress == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	agile, err := agileapi.NewWithConfig(agileapi.Config{
+		Username: *user,
+		Password: *password,
+		Url:      *api,
+		Debug:    *debug,
+	})
+	if err != nil {
+		log.Fatal("Authentication Failed: ", err)
+	}
+
+	handler := agiledav.WithContentLength(&webdav.Handler{
+		FileSystem: agiledav.New(agile.NewFS(*egress)),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	})
+	if *auth != "" {
+		handler = basicAuth(*auth, handler)
+	}
+	log.Println("Serving WebDAV on " + *listen)
+	log.Fatal(http.ListenAndServe(*listen, handler))
+}
+
+func basicAuth(auth string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user+":"+password != auth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="agile"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,342 @@
+// Package agilestub is a minimal Agile JSON-RPC, upload and egress server for
+// the tests of agileapi and its gateways.  Tokens are "token-1",
+// "token-2"... and only the latest is valid.
+package agilestub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const codeTokenExpired = -10001
+
+// Server is the stub.  Lock it around any change to its exported fields.
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+
+	Logins int
+	token  string
+	// ExpireAfter, when above zero, expires the token after that many more
+	// calls that use it.
+	ExpireAfter int
+	// FailLogins makes login fail.
+	FailLogins bool
+	// NoChecksums leaves checksums out of stats and listings, as Agile does
+	// for some files.  Egress still sends them as X-Agile-Checksum.
+	NoChecksums bool
+	// ListCodes makes listings of a path fail with that code.
+	ListCodes map[string]int
+	Files     map[string]Stat
+	Uploads   map[string][]byte
+	// calls has the method and token of every call, oldest first.
+	calls []Call
+}
+
+// Stat is what stat and the listings return for a path.
+type Stat struct {
+	Code     int    `json:"code"`
+	Mtime    int    `json:"mtime"`
+	Size     int    `json:"size"`
+	Type     int    `json:"type"`
+	Ctime    int    `json:"ctime"`
+	Checksum string `json:"checksum"`
+	MimeType string `json:"mimetype"`
+}
+
+type Call struct {
+	Method string
+	Token  string
+}
+
+type request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Id     json.RawMessage   `json:"id"`
+}
+
+// New starts a stub that is closed when t finishes.
+func New(t testing.TB) *Server {
+	me := &Server{Files: map[string]Stat{}, Uploads: map[string][]byte{}, ListCodes: map[string]int{}}
+	me.Server = httptest.NewServer(http.HandlerFunc(me.serve))
+	t.Cleanup(me.Server.Close)
+	return me
+}
+
+// Transport sends every request, uploads and egress included, to the stub
+// whatever host it was addressed to.
+func (me *Server) Transport() http.RoundTripper {
+	return transport{me.Server}
+}
+
+type transport struct {
+	server *httptest.Server
+}
+
+func (me transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = strings.TrimPrefix(me.server.URL, "http://")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Expire invalidates the current token.
+func (me *Server) Expire() {
+	me.Lock()
+	defer me.Unlock()
+	me.token = "expired"
+}
+
+// Calls returns every call so far, oldest first.
+func (me *Server) Calls() []Call {
+	me.Lock()
+	defer me.Unlock()
+	return append([]Call(nil), me.calls...)
+}
+
+// Put stores a file as if it had been uploaded.
+func (me *Server) Put(mypath string, data []byte) {
+	me.Lock()
+	defer me.Unlock()
+	me.Uploads[mypath] = data
+	me.Files[mypath] = stat(data)
+}
+
+// Contents returns what is stored at mypath.
+func (me *Server) Contents(mypath string) ([]byte, bool) {
+	me.Lock()
+	defer me.Unlock()
+	data, ok := me.Uploads[mypath]
+	return data, ok
+}
+
+// Paths returns every stored path, sorted.
+func (me *Server) Paths() []string {
+	me.Lock()
+	defer me.Unlock()
+	var paths []string
+	for mypath := range me.Files {
+		paths = append(paths, mypath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (me *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/post/raw" {
+		me.upload(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/egress/") {
+		me.egress(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var requests []request
+		json.Unmarshal(body, &requests)
+		responses := make([]json.RawMessage, len(requests))
+		for i, request := range requests {
+			responses[i] = me.reply(request)
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+	var request request
+	json.Unmarshal(body, &request)
+	w.Write(me.reply(request))
+}
+
+func (me *Server) reply(request request) json.RawMessage {
+	me.Lock()
+	defer me.Unlock()
+	var token string
+	if len(request.Params) > 0 {
+		json.Unmarshal(request.Params[0], &token)
+	}
+	me.calls = append(me.calls, Call{Method: request.Method, Token: token})
+	var result interface{}
+	if request.Method == "login" && me.FailLogins {
+		result = []interface{}{}
+	} else if request.Method == "login" {
+		me.Logins++
+		me.token = fmt.Sprintf("token-%d", me.Logins)
+		result = []interface{}{me.token, nil}
+	} else if token != me.token {
+		result = codeTokenExpired
+		if request.Method == "noop" || request.Method == "stat" {
+			result = map[string]int{"code": codeTokenExpired}
+		}
+	} else {
+		if me.ExpireAfter > 0 {
+			me.ExpireAfter--
+			if me.ExpireAfter == 0 {
+				me.token = "expired"
+			}
+		}
+		result = me.call(request)
+	}
+	output, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": request.Id, "result": result})
+	return output
+}
+
+// call runs an authorised call.  The caller holds the lock.
+func (me *Server) call(request request) interface{} {
+	var path, other string
+	if len(request.Params) > 1 {
+		json.Unmarshal(request.Params[1], &path)
+	}
+	if len(request.Params) > 2 {
+		json.Unmarshal(request.Params[2], &other)
+	}
+	switch request.Method {
+	case "noop":
+		return map[string]int{"code": 0}
+	case "stat":
+		stat, ok := me.Files[path]
+		if !ok && path != "/" && !me.isDir(path) {
+			return map[string]int{"code": -1}
+		}
+		if !ok {
+			stat = Stat{Type: 1}
+		}
+		if me.NoChecksums {
+			stat.Checksum = ""
+		}
+		return stat
+	case "listFile", "listDir":
+		return me.list(request.Method, path)
+	case "deleteFile", "deleteDir":
+		delete(me.Files, path)
+		delete(me.Uploads, path)
+	case "makeDir2":
+		me.Files[path] = Stat{Type: 1}
+	case "setContentType":
+		stat, ok := me.Files[path]
+		if !ok {
+			return -1
+		}
+		stat.MimeType = other
+		me.Files[path] = stat
+	case "setMTime":
+		if stat, ok := me.Files[path]; ok {
+			stat.Mtime, _ = strconv.Atoi(other)
+			me.Files[path] = stat
+		}
+	case "renameFile":
+		stat, ok := me.Files[path]
+		if !ok {
+			return -1
+		}
+		me.Files[other] = stat
+		me.Uploads[other] = me.Uploads[path]
+		delete(me.Files, path)
+		delete(me.Uploads, path)
+	}
+	return 0
+}
+
+// isDir is whether anything is stored under mypath.  The caller holds the
+// lock.
+func (me *Server) isDir(mypath string) bool {
+	if me.Files[mypath].Type == 1 {
+		return true
+	}
+	for name := range me.Files {
+		if strings.HasPrefix(name, strings.TrimSuffix(mypath, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// list answers listFile and listDir from the stored paths.  The caller
+// holds the lock.
+func (me *Server) list(method, dir string) interface{} {
+	if code, ok := me.ListCodes[dir]; ok {
+		return map[string]int{"code": code}
+	}
+	if dir != "/" && !me.isDir(dir) {
+		return map[string]int{"code": -1}
+	}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	seen := map[string]bool{}
+	var names []string
+	for name, stat := range me.Files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		isdir := stat.Type == 1
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest, isdir = rest[:i], true
+		}
+		if isdir == (method == "listDir") && !seen[rest] {
+			seen[rest] = true
+			names = append(names, rest)
+		}
+	}
+	sort.Strings(names)
+	list := []map[string]interface{}{}
+	for _, name := range names {
+		stat := me.Files[prefix+name]
+		if me.NoChecksums {
+			stat.Checksum = ""
+		}
+		kind := 2
+		if method == "listDir" {
+			kind = 1
+		}
+		list = append(list, map[string]interface{}{"type": kind, "name": name, "stat": stat})
+	}
+	return map[string]interface{}{"list": list, "code": 0, "cookie": 0}
+}
+
+func (me *Server) upload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	me.Lock()
+	defer me.Unlock()
+	token := r.Header.Get("X-Agile-Authorization")
+	me.calls = append(me.calls, Call{Method: "upload", Token: token})
+	if err != nil || token != me.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	mypath := strings.TrimSuffix(r.Header.Get("X-Agile-Directory"), "/") + "/" + r.Header.Get("X-Agile-Basename")
+	me.Uploads[mypath] = data
+	me.Files[mypath] = stat(data)
+	if contenttype := r.Header.Get("X-Agile-Content-Type"); contenttype != "" {
+		uploaded := me.Files[mypath]
+		uploaded.MimeType = contenttype
+		me.Files[mypath] = uploaded
+	}
+}
+
+func (me *Server) egress(w http.ResponseWriter, r *http.Request) {
+	me.Lock()
+	data, ok := me.Uploads[strings.TrimPrefix(r.URL.Path, "/egress")]
+	me.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Agile-Checksum", stat(data).Checksum)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func stat(data []byte) Stat {
+	sum := sha256.Sum256(data)
+	return Stat{Type: 2, Size: len(data), Checksum: hex.EncodeToString(sum[:])}
+}